@@ -1,31 +1,585 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+/*
+ * Configuration
+ *
+ * Settings are resolved in increasing order of precedence:
+ *
+ *  1. built-in defaults, see defaultConfig
+ *  2. the YAML config file, config.yml unless --config or CONFIG_FILE say otherwise
+ *  3. environment variables, named after the YAML path, e.g. ANIMATED_WIDTH
+ *  4. command-line flags, the same path lower-cased, e.g. --animated-width
+ *
+ * Lists are comma-separated in environment variables and flags, maps
+ * (QUEUE.WORKERS) can only be set from the config file.
+ */
+
 type Config struct {
-	PublishedURI string `yaml:"PUBLISHED_URI"`
+	PublishedURI    string        `yaml:"PUBLISHED_URI" help:"public base URL used in artwork links (default: http://<device IP>)"`
+	ListenAddr      string        `yaml:"LISTEN_ADDR" help:"address the HTTP server listens on"`
+	CacheDir        string        `yaml:"CACHE_DIR" help:"directory generated artwork is stored in (default: cache next to the executable)"`
+	RequestTimeout  time.Duration `yaml:"REQUEST_TIMEOUT" help:"how long generate endpoints wait for their job before responding"`
+	ShutdownTimeout time.Duration `yaml:"SHUTDOWN_TIMEOUT" help:"how long to wait for running jobs on shutdown before killing them"`
+
+	URLPolicy    URLPolicyConfig    `yaml:"URL_POLICY"`
+	Outbound     OutboundConfig     `yaml:"OUTBOUND"`
+	Download     DownloadConfig     `yaml:"DOWNLOAD"`
+	Fetch        FetchConfig        `yaml:"FETCH"`
+	Queue        QueueConfig        `yaml:"QUEUE"`
+	Animated     AnimatedConfig     `yaml:"ANIMATED"`
+	ArtistSquare ArtistSquareConfig `yaml:"ARTIST_SQUARE"`
+	ICloud       ICloudConfig       `yaml:"ICLOUD"`
+
+	// path is the config file the settings were read from, it may not exist.
+	path string
+}
+
+type QueueConfig struct {
+	Backend   string `yaml:"BACKEND" help:"job queue backend: memory, disk or redis"`
+	Dir       string `yaml:"DIR" help:"directory for the disk queue backend (default: <cache>/jobs)"`
+	RedisAddr string `yaml:"REDIS_ADDR" env:"REDIS_ADDR" help:"address of the redis queue backend"`
+	// Workers maps a task type (e.g. "artwork:generate") to its concurrency.
+	Workers map[string]int `yaml:"WORKERS"`
+}
+
+// URLPolicyConfig restricts which source URLs are accepted. In the
+// per-endpoint sections, empty lists fall back to the top-level URL_POLICY.
+type URLPolicyConfig struct {
+	Schemes []string `yaml:"SCHEMES" help:"allowed URL schemes"`
+	Hosts   []string `yaml:"HOSTS" help:"allowed hosts, *.example.com matches any subdomain of example.com"`
+	Ports   []int    `yaml:"PORTS" help:"allowed explicit ports, the scheme's default port is always allowed"`
+}
+
+// OutboundConfig controls which addresses source URLs may resolve to.
+type OutboundConfig struct {
+	AllowPrivateNetworks bool     `yaml:"ALLOW_PRIVATE_NETWORKS" help:"allow fetching from private, loopback and link-local addresses"`
+	AllowedNetworks      []string `yaml:"ALLOWED_NETWORKS" help:"CIDR ranges that may be fetched from even though they are private"`
+	MaxRedirects         int      `yaml:"MAX_REDIRECTS" help:"how many redirects to follow when fetching a source URL"`
+}
+
+// DownloadConfig limits the source images that are downloaded and decoded.
+type DownloadConfig struct {
+	MaxBytes     int `yaml:"MAX_BYTES" help:"largest source image download in bytes"`
+	MaxDimension int `yaml:"MAX_DIMENSION" help:"largest source image width or height in pixels"`
+	MaxPixels    int `yaml:"MAX_PIXELS" help:"largest source image area in pixels"`
+}
+
+// FetchConfig controls how source images are fetched and cached.
+type FetchConfig struct {
+	Concurrency     int           `yaml:"CONCURRENCY" help:"how many images of one artist square are downloaded at once"`
+	MaxConnsPerHost int           `yaml:"MAX_CONNS_PER_HOST" help:"most connections to one source host, shared by every job"`
+	Timeout         time.Duration `yaml:"TIMEOUT" help:"how long a single attempt at fetching a source image may take"`
+	Retries         int           `yaml:"RETRIES" help:"how often a failed fetch is retried"`
+	RetryWait       time.Duration `yaml:"RETRY_WAIT" help:"wait before the first retry, doubled for every retry after it"`
+	RetryMaxWait    time.Duration `yaml:"RETRY_MAX_WAIT" help:"longest wait between retries"`
+	Cache           bool          `yaml:"CACHE" help:"keep source images with an ETag and revalidate them instead of downloading them again"`
+	CacheMaxAge     time.Duration `yaml:"CACHE_MAX_AGE" help:"remove cached source images unused for this long on startup, 0 keeps them"`
+}
+
+type AnimatedConfig struct {
+	Width     int             `yaml:"WIDTH" help:"width of generated animated artwork in pixels"`
+	Threads   int             `yaml:"THREADS" help:"ffmpeg threads per animated artwork job, 0 lets ffmpeg decide"`
+	Timeout   time.Duration   `yaml:"TIMEOUT" help:"how long an animated artwork job may run"`
+	URLPolicy URLPolicyConfig `yaml:"URL_POLICY"`
+	Variant   VariantConfig   `yaml:"VARIANT"`
+	Output    OutputConfig    `yaml:"OUTPUT"`
+
+	AllowedWidths []int         `yaml:"ALLOWED_WIDTHS" help:"widths requests may ask for besides WIDTH"`
+	MaxFPS        int           `yaml:"MAX_FPS" help:"highest frame rate requests may ask for"`
+	MaxDuration   time.Duration `yaml:"MAX_DURATION" help:"longest animated artwork that is generated, also for requests that don't ask for a duration, 0 for no limit"`
+
+	Presets map[string]PresetConfig `yaml:"PRESETS"`
+
+	GenerateMissing bool `yaml:"GENERATE_MISSING" help:"generate the format a client's Accept header prefers when it doesn't exist yet"`
+}
+
+// PresetConfig is a named set of encoding settings for animated artwork,
+// selected with the preset query parameter. Presets are only configurable in
+// the config file, the built-in ones are in defaultPresets.
+type PresetConfig struct {
+	// FORMAT is the output format: gif, webp, avif, apng, mp4 (H.264) or
+	// hevc (HEVC in fragmented MP4)
+	Format string `yaml:"FORMAT"`
+	// CODEC is the ffmpeg encoder, empty for the format's default
+	Codec string `yaml:"CODEC"`
+	// FILTERS are extra ffmpeg filters, applied after scaling
+	Filters string `yaml:"FILTERS"`
+	// QUALITY is the encoder quality from 0 to 100, 0 for the encoder default
+	Quality int `yaml:"QUALITY"`
+	// WIDTH and FPS are the defaults when the request doesn't ask for any,
+	// 0 uses ANIMATED.WIDTH and the source frame rate
+	Width int `yaml:"WIDTH"`
+	FPS   int `yaml:"FPS"`
+	// MAX_DURATION clips the artwork if it is below ANIMATED.MAX_DURATION, 0
+	// leaves it at that
+	MaxDuration time.Duration `yaml:"MAX_DURATION"`
+	// OPTIONS are passed to ffmpeg as further output options
+	Options map[string]string `yaml:"OPTIONS"`
+}
+
+// OutputConfig limits the animated artwork that is kept, anything bigger is
+// treated as a failed generation.
+type OutputConfig struct {
+	MaxBytes  int `yaml:"MAX_BYTES" help:"largest generated animated artwork in bytes"`
+	MaxFrames int `yaml:"MAX_FRAMES" help:"most frames generated animated artwork may have"`
+}
+
+// VariantConfig controls which of a playlist's streams animated artwork is
+// generated from, see variantPolicy.
+type VariantConfig struct {
+	PreferCodec  string `yaml:"PREFER_CODEC" help:"codec to prefer when several are offered, avc1 or hvc1, empty for no preference"`
+	PreferSDR    bool   `yaml:"PREFER_SDR" help:"prefer SDR streams over HDR and Dolby Vision ones"`
+	MinWidth     int    `yaml:"MIN_WIDTH" help:"ignore streams narrower than this many pixels"`
+	MaxBandwidth int    `yaml:"MAX_BANDWIDTH" help:"ignore streams above this many bits per second, 0 for no limit"`
+}
+
+type ArtistSquareConfig struct {
+	Size             int             `yaml:"SIZE" help:"width and height of artist squares in pixels"`
+	JPEGQuality      int             `yaml:"JPEG_QUALITY" help:"JPEG quality of artist squares (1-100)"`
+	AllowedSizes     []int           `yaml:"ALLOWED_SIZES" help:"sizes requests may ask for besides SIZE"`
+	Layout           string          `yaml:"LAYOUT" help:"layout of artist squares whose request doesn't name one"`
+	Gutter           int             `yaml:"GUTTER" help:"pixels between the images of an artist square"`
+	GutterColor      string          `yaml:"GUTTER_COLOR" help:"colour of the gutter as #rrggbb"`
+	OnMissing        string          `yaml:"ON_MISSING" help:"what to do about images that fail to download: strict, skip or placeholder"`
+	PlaceholderColor string          `yaml:"PLACEHOLDER_COLOR" help:"colour of placeholder tiles as #rrggbb"`
+	MissingMaxAge    time.Duration   `yaml:"MISSING_MAX_AGE" help:"how long a square made with missing images is reused before it is made again, 0 never reuses it"`
+	Timeout          time.Duration   `yaml:"TIMEOUT" help:"how long an artist square job may run"`
+	URLPolicy        URLPolicyConfig `yaml:"URL_POLICY"`
 }
 
-func getBaseURI() string {
-	// Check for config.yml file first
-	config := &Config{}
-	if configFile, err := os.Open("config.yml"); err == nil {
-		defer configFile.Close()
-		if err := yaml.NewDecoder(configFile).Decode(config); err == nil && config.PublishedURI != "" {
-			return config.PublishedURI
+type ICloudConfig struct {
+	Size        int             `yaml:"SIZE" help:"width and height of iCloud art in pixels"`
+	JPEGQuality int             `yaml:"JPEG_QUALITY" help:"JPEG quality of iCloud art (1-100)"`
+	Timeout     time.Duration   `yaml:"TIMEOUT" help:"how long an iCloud art job may run"`
+	URLPolicy   URLPolicyConfig `yaml:"URL_POLICY"`
+}
+
+// liveConfig holds the settings currently in effect, it is swapped as a whole
+// when the config file is reloaded.
+var liveConfig atomic.Pointer[Config]
+
+func currentConfig() *Config {
+	return liveConfig.Load()
+}
+
+// defaultWorkers is merged into QUEUE.WORKERS after the config file is read,
+// it also lists every task type that can be configured.
+var defaultWorkers = map[string]int{
+	TypeGenerateArtwork:      2,
+	TypeGenerateAltArtwork:   2,
+	TypeGenerateVideoArtwork: 2,
+	TypeCreateArtistSquare:   4,
+	TypeCreateICloudArt:      4,
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:      ":3000",
+		RequestTimeout:  30 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		URLPolicy: URLPolicyConfig{
+			Schemes: []string{"https"},
+			Hosts:   []string{"*.apple.com", "*.mzstatic.com"},
+		},
+		Outbound: OutboundConfig{
+			MaxRedirects: 5,
+		},
+		Download: DownloadConfig{
+			MaxBytes:     20 << 20,
+			MaxDimension: 8192,
+			MaxPixels:    40000000,
+		},
+		Fetch: FetchConfig{
+			Concurrency:     4,
+			MaxConnsPerHost: 8,
+			Timeout:         30 * time.Second,
+			Retries:         3,
+			RetryWait:       time.Second,
+			RetryMaxWait:    5 * time.Second,
+			Cache:           true,
+			CacheMaxAge:     30 * 24 * time.Hour,
+		},
+		Queue: QueueConfig{
+			Backend: "disk",
+		},
+		Animated: AnimatedConfig{
+			Width:   486,
+			Threads: 8,
+			Timeout: 5 * time.Minute,
+			Variant: VariantConfig{
+				PreferSDR: true,
+				MinWidth:  450,
+			},
+			Output: OutputConfig{
+				MaxBytes:  50 << 20,
+				MaxFrames: 3600,
+			},
+			AllowedWidths: []int{128, 256, 512, 1024},
+			MaxFPS:        30,
+			MaxDuration:   time.Minute,
+		},
+		ArtistSquare: ArtistSquareConfig{
+			Size:             500,
+			JPEGQuality:      95,
+			AllowedSizes:     []int{250, 1000, 2000},
+			Layout:           "grid",
+			GutterColor:      "#000000",
+			OnMissing:        "strict",
+			PlaceholderColor: "#333333",
+			MissingMaxAge:    time.Hour,
+			Timeout:          2 * time.Minute,
+		},
+		ICloud: ICloudConfig{
+			Size:        1024,
+			JPEGQuality: 95,
+			Timeout:     2 * time.Minute,
+		},
+	}
+}
+
+// configField is a single settable value in Config, path holds the YAML keys
+// leading to it. alias is an older environment variable still accepted for
+// it, from the env tag.
+type configField struct {
+	path  []string
+	alias string
+	help  string
+	value reflect.Value
+}
+
+func (f configField) envName() string {
+	return strings.Join(f.path, "_")
+}
+
+func (f configField) flagName() string {
+	return strings.ToLower(strings.ReplaceAll(strings.Join(f.path, "-"), "_", "-"))
+}
+
+func configFields(v reflect.Value, path []string) []configField {
+	var fields []configField
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Tag.Get("yaml")
+		fieldPath := append(append([]string{}, path...), name)
+
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			fields = append(fields, configFields(v.Field(i), fieldPath)...)
+		case reflect.Map:
+			// Only settable from the config file
+		default:
+			fields = append(fields, configField{
+				path:  fieldPath,
+				alias: field.Tag.Get("env"),
+				help:  field.Tag.Get("help"),
+				value: v.Field(i),
+			})
 		}
 	}
+	return fields
+}
 
-	// If config.yml doesn't exist or doesn't contain PUBLISHED_URI, check for environment variable
-	if envURI := os.Getenv("PUBLISHED_URI"); envURI != "" {
-		return envURI
+func setConfigValue(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
 	}
 
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		items := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, part := range strings.Split(raw, ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := setConfigValue(item, part); err != nil {
+				return err
+			}
+			items = reflect.Append(items, item)
+		}
+		v.Set(items)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// loadConfig resolves the configuration from the config file, environment
+// and command-line arguments, see the top of this file for the precedence.
+func loadConfig(args []string) (*Config, error) {
+	config := defaultConfig()
+	fields := configFields(reflect.ValueOf(config).Elem(), nil)
+
+	flags := flag.NewFlagSet("aniart", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to the YAML config file (default: config.yml, or CONFIG_FILE)")
+	flagValues := make(map[string]*string)
+	for _, field := range fields {
+		env := field.envName()
+		if field.alias != "" {
+			env += " or " + field.alias
+		}
+		flagValues[field.flagName()] = flags.String(field.flagName(), "", fmt.Sprintf("%s (env %s)", field.help, env))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Config file
+	path := *configPath
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	explicitPath := path != ""
+	if !explicitPath {
+		path = "config.yml"
+	}
+	config.path = path
+	if data, err := os.ReadFile(path); err == nil {
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	} else if explicitPath || !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// Environment variables
+	for _, field := range fields {
+		// The current name wins over the alias
+		for _, name := range []string{field.alias, field.envName()} {
+			if raw, ok := os.LookupEnv(name); name != "" && ok && raw != "" {
+				if err := setConfigValue(field.value, raw); err != nil {
+					return nil, fmt.Errorf("invalid %s: %w", name, err)
+				}
+			}
+		}
+	}
+
+	// Command-line flags, only the ones that were actually passed
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, field := range fields {
+		if set[field.flagName()] {
+			if err := setConfigValue(field.value, *flagValues[field.flagName()]); err != nil {
+				return nil, fmt.Errorf("invalid --%s: %w", field.flagName(), err)
+			}
+		}
+	}
+
+	// Worker counts the config file didn't set
+	if config.Queue.Workers == nil {
+		config.Queue.Workers = make(map[string]int)
+	}
+	for taskType, count := range defaultWorkers {
+		if _, ok := config.Queue.Workers[taskType]; !ok {
+			config.Queue.Workers[taskType] = count
+		}
+	}
+	if config.Animated.Presets == nil {
+		config.Animated.Presets = make(map[string]PresetConfig)
+	}
+	for name, preset := range defaultPresets {
+		if _, ok := config.Animated.Presets[name]; !ok {
+			config.Animated.Presets[name] = preset
+		}
+	}
+
+	// Settings whose defaults depend on the environment
+	if config.PublishedURI == "" {
+		config.PublishedURI = defaultPublishedURI()
+	}
+	config.PublishedURI = strings.TrimSuffix(config.PublishedURI, "/")
+	if config.CacheDir == "" {
+		ex, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine cache directory: %w", err)
+		}
+		config.CacheDir = filepath.Join(filepath.Dir(ex), "cache")
+	}
+	if config.Queue.Dir == "" {
+		config.Queue.Dir = filepath.Join(config.CacheDir, "jobs")
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validate reports every invalid setting at once rather than just the first.
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if u, err := url.Parse(c.PublishedURI); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("PUBLISHED_URI must be an absolute http(s) URL, got %q", c.PublishedURI))
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("LISTEN_ADDR must be host:port, got %q", c.ListenAddr))
+	}
+	check(c.RequestTimeout > 0, "REQUEST_TIMEOUT must be positive")
+	check(c.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+
+	switch c.Queue.Backend {
+	case "memory", "disk":
+	case "redis":
+		check(c.Queue.RedisAddr != "", "QUEUE.REDIS_ADDR is required for the redis backend")
+	default:
+		errs = append(errs, fmt.Errorf("QUEUE.BACKEND must be memory, disk or redis, got %q", c.Queue.Backend))
+	}
+	for taskType, count := range c.Queue.Workers {
+		_, known := defaultWorkers[taskType]
+		check(known, "QUEUE.WORKERS: unknown task type %q", taskType)
+		check(count >= 1, "QUEUE.WORKERS: %s must have at least 1 worker", taskType)
+	}
+
+	errs = append(errs, c.URLPolicy.validate("URL_POLICY", true)...)
+	errs = append(errs, c.Animated.URLPolicy.validate("ANIMATED.URL_POLICY", false)...)
+	errs = append(errs, c.ArtistSquare.URLPolicy.validate("ARTIST_SQUARE.URL_POLICY", false)...)
+	errs = append(errs, c.ICloud.URLPolicy.validate("ICLOUD.URL_POLICY", false)...)
+
+	for _, cidr := range c.Outbound.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("OUTBOUND.ALLOWED_NETWORKS: invalid CIDR %q", cidr))
+		}
+	}
+	check(c.Outbound.MaxRedirects >= 0 && c.Outbound.MaxRedirects <= 20, "OUTBOUND.MAX_REDIRECTS must be between 0 and 20")
+	check(c.Download.MaxBytes > 0, "DOWNLOAD.MAX_BYTES must be positive")
+	check(c.Download.MaxDimension > 0, "DOWNLOAD.MAX_DIMENSION must be positive")
+	check(c.Download.MaxPixels > 0, "DOWNLOAD.MAX_PIXELS must be positive")
+
+	check(c.Fetch.Concurrency >= 1, "FETCH.CONCURRENCY must be at least 1")
+	check(c.Fetch.MaxConnsPerHost >= 1, "FETCH.MAX_CONNS_PER_HOST must be at least 1")
+	check(c.Fetch.Timeout > 0, "FETCH.TIMEOUT must be positive")
+	check(c.Fetch.Retries >= 0, "FETCH.RETRIES must not be negative")
+	check(c.Fetch.RetryWait > 0 && c.Fetch.RetryWait <= c.Fetch.RetryMaxWait, "FETCH.RETRY_WAIT must be positive and at most FETCH.RETRY_MAX_WAIT")
+	check(c.Fetch.CacheMaxAge >= 0, "FETCH.CACHE_MAX_AGE must not be negative")
+
+	check(c.Animated.Width >= 16 && c.Animated.Width <= 4096, "ANIMATED.WIDTH must be between 16 and 4096")
+	check(c.Animated.Threads >= 0 && c.Animated.Threads <= 64, "ANIMATED.THREADS must be between 0 and 64")
+	check(c.Animated.Timeout > 0, "ANIMATED.TIMEOUT must be positive")
+	switch c.Animated.Variant.PreferCodec {
+	case "", "avc1", "hvc1":
+	default:
+		errs = append(errs, fmt.Errorf("ANIMATED.VARIANT.PREFER_CODEC must be avc1, hvc1 or empty, got %q", c.Animated.Variant.PreferCodec))
+	}
+	check(c.Animated.Variant.MinWidth >= 0, "ANIMATED.VARIANT.MIN_WIDTH must not be negative")
+	check(c.Animated.Variant.MaxBandwidth >= 0, "ANIMATED.VARIANT.MAX_BANDWIDTH must not be negative")
+	check(c.Animated.Output.MaxBytes > 0, "ANIMATED.OUTPUT.MAX_BYTES must be positive")
+	check(c.Animated.Output.MaxFrames > 0, "ANIMATED.OUTPUT.MAX_FRAMES must be positive")
+	for _, width := range c.Animated.AllowedWidths {
+		check(width >= 16 && width <= 4096, "ANIMATED.ALLOWED_WIDTHS must be between 16 and 4096, got %d", width)
+	}
+	check(c.Animated.MaxFPS >= 1 && c.Animated.MaxFPS <= 120, "ANIMATED.MAX_FPS must be between 1 and 120")
+	check(c.Animated.MaxDuration >= 0, "ANIMATED.MAX_DURATION must not be negative")
+	for name, preset := range c.Animated.Presets {
+		errs = append(errs, preset.validate("ANIMATED.PRESETS."+name)...)
+	}
+
+	check(c.ArtistSquare.Size >= 16 && c.ArtistSquare.Size <= 4096, "ARTIST_SQUARE.SIZE must be between 16 and 4096")
+	check(c.ArtistSquare.JPEGQuality >= 1 && c.ArtistSquare.JPEGQuality <= 100, "ARTIST_SQUARE.JPEG_QUALITY must be between 1 and 100")
+	for _, size := range c.ArtistSquare.AllowedSizes {
+		check(size >= 16 && size <= 4096, "ARTIST_SQUARE.ALLOWED_SIZES must be between 16 and 4096, got %d", size)
+	}
+	if _, ok := artistSquareLayouts[c.ArtistSquare.Layout]; !ok {
+		errs = append(errs, fmt.Errorf("ARTIST_SQUARE.LAYOUT must be one of %s, got %q", strings.Join(layoutNames(), ", "), c.ArtistSquare.Layout))
+	}
+	check(c.ArtistSquare.Gutter >= 0 && c.ArtistSquare.Gutter*10 <= c.ArtistSquare.Size, "ARTIST_SQUARE.GUTTER must be between 0 and a tenth of SIZE")
+	if _, err := parseHexColor(c.ArtistSquare.GutterColor); err != nil {
+		errs = append(errs, fmt.Errorf("ARTIST_SQUARE.GUTTER_COLOR: %w", err))
+	}
+	if !slices.Contains(missingPolicies, c.ArtistSquare.OnMissing) {
+		errs = append(errs, fmt.Errorf("ARTIST_SQUARE.ON_MISSING must be one of %s, got %q", strings.Join(missingPolicies, ", "), c.ArtistSquare.OnMissing))
+	}
+	if _, err := parseHexColor(c.ArtistSquare.PlaceholderColor); err != nil {
+		errs = append(errs, fmt.Errorf("ARTIST_SQUARE.PLACEHOLDER_COLOR: %w", err))
+	}
+	check(c.ArtistSquare.MissingMaxAge >= 0, "ARTIST_SQUARE.MISSING_MAX_AGE must not be negative")
+	check(c.ArtistSquare.Timeout > 0, "ARTIST_SQUARE.TIMEOUT must be positive")
+
+	check(c.ICloud.Size >= 16 && c.ICloud.Size <= 4096, "ICLOUD.SIZE must be between 16 and 4096")
+	check(c.ICloud.JPEGQuality >= 1 && c.ICloud.JPEGQuality <= 100, "ICLOUD.JPEG_QUALITY must be between 1 and 100")
+	check(c.ICloud.Timeout > 0, "ICLOUD.TIMEOUT must be positive")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// validate checks a URL policy, required is set for the top-level policy
+// which has nothing to fall back to.
+func (p URLPolicyConfig) validate(name string, required bool) []error {
+	var errs []error
+	if required && len(p.Schemes) == 0 {
+		errs = append(errs, fmt.Errorf("%s.SCHEMES must not be empty", name))
+	}
+	if required && len(p.Hosts) == 0 {
+		errs = append(errs, fmt.Errorf("%s.HOSTS must not be empty", name))
+	}
+	for _, scheme := range p.Schemes {
+		if scheme != "http" && scheme != "https" {
+			errs = append(errs, fmt.Errorf("%s.SCHEMES: unsupported scheme %q, only http and https can be fetched", name, scheme))
+		}
+	}
+	for _, host := range p.Hosts {
+		pattern := strings.TrimPrefix(host, "*.")
+		if pattern == "" || strings.ContainsAny(pattern, "*/:") || strings.HasPrefix(pattern, ".") {
+			errs = append(errs, fmt.Errorf("%s.HOSTS: invalid host pattern %q", name, host))
+		}
+	}
+	for _, port := range p.Ports {
+		if port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("%s.PORTS: invalid port %d", name, port))
+		}
+	}
+	return errs
+}
+
+func defaultPublishedURI() string {
 	// Default to device IP if neither config file nor environment variable is set
 	addrs, err := net.InterfaceAddrs()
 	if err == nil {
@@ -41,3 +595,23 @@ func getBaseURI() string {
 	// Fallback to localhost if we can't determine the IP
 	return "http://localhost"
 }
+
+func (p PresetConfig) validate(name string) []error {
+	var errs []error
+	if lookupFormat(p.Format) == nil {
+		errs = append(errs, fmt.Errorf("%s.FORMAT must be one of %s, got %q", name, strings.Join(formatNames(), ", "), p.Format))
+	}
+	if p.Quality < 0 || p.Quality > 100 {
+		errs = append(errs, fmt.Errorf("%s.QUALITY must be between 0 and 100", name))
+	}
+	if p.Width != 0 && (p.Width < 16 || p.Width > 4096) {
+		errs = append(errs, fmt.Errorf("%s.WIDTH must be between 16 and 4096", name))
+	}
+	if p.FPS < 0 || p.FPS > 120 {
+		errs = append(errs, fmt.Errorf("%s.FPS must be between 0 and 120", name))
+	}
+	if p.MaxDuration < 0 {
+		errs = append(errs, fmt.Errorf("%s.MAX_DURATION must not be negative", name))
+	}
+	return errs
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useConfigFile makes loadConfig read contents as its config file, with a
+// cache directory of its own.
+func useConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(configFile, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+	t.Setenv("CACHE_DIR", t.TempDir())
+	return configFile
+}
+
+func TestLoadConfigEnvAlias(t *testing.T) {
+	useConfigFile(t, "")
+
+	t.Setenv("REDIS_ADDR", "10.0.0.1:6379")
+	config, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Queue.RedisAddr != "10.0.0.1:6379" {
+		t.Errorf("REDIS_ADDR gave QUEUE.REDIS_ADDR %q", config.Queue.RedisAddr)
+	}
+
+	t.Setenv("QUEUE_REDIS_ADDR", "10.0.0.2:6379")
+	if config, err = loadConfig(nil); err != nil {
+		t.Fatal(err)
+	}
+	if config.Queue.RedisAddr != "10.0.0.2:6379" {
+		t.Errorf("QUEUE_REDIS_ADDR didn't win over REDIS_ADDR, got %q", config.Queue.RedisAddr)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	useConfigFile(t, `
+ANIMATED:
+  WIDTH: 256
+  MAX_FPS: 24
+  PRESETS:
+    discord:
+      FORMAT: gif
+      MAX_DURATION: 10s
+ARTIST_SQUARE:
+  SIZE: 600
+  LAYOUT: mosaic
+`)
+	t.Setenv("ANIMATED_MAX_FPS", "20")
+	t.Setenv("ARTIST_SQUARE_SIZE", "700")
+	// Empty variables are as good as unset
+	t.Setenv("ARTIST_SQUARE_LAYOUT", "")
+
+	config, err := loadConfig([]string{"--artist-square-size", "800", "--fetch-retries=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		setting   string
+		got, want any
+	}{
+		{"REQUEST_TIMEOUT, the default", config.RequestTimeout, defaultConfig().RequestTimeout},
+		{"ANIMATED.WIDTH, from YAML", config.Animated.Width, 256},
+		{"ANIMATED.MAX_FPS, from env over YAML", config.Animated.MaxFPS, 20},
+		{"ARTIST_SQUARE.SIZE, from the flag over env and YAML", config.ArtistSquare.Size, 800},
+		{"ARTIST_SQUARE.LAYOUT, from YAML under an empty env", config.ArtistSquare.Layout, "mosaic"},
+		{"FETCH.RETRIES, from the flag over the default", config.Fetch.Retries, 1},
+		{"the YAML preset", config.Animated.Presets["discord"].MaxDuration, 10 * time.Second},
+		{"the built-in presets", config.Animated.Presets["gif"], defaultPresets["gif"]},
+	} {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		yaml string
+		env  map[string]string
+		args []string
+		// want are all part of the error
+		want []string
+	}{
+		{name: "unknown key", yaml: "BOGUS: 1\n", want: []string{"field BOGUS not found"}},
+		{name: "unknown nested key", yaml: "ANIMATED:\n  WIDHT: 256\n", want: []string{"field WIDHT not found"}},
+		{name: "wrong type", yaml: "ANIMATED:\n  WIDTH: wide\n", want: []string{"invalid config file"}},
+		{name: "out of range", yaml: "ANIMATED:\n  WIDTH: 8\n", want: []string{"ANIMATED.WIDTH must be between 16 and 4096"}},
+		{name: "every error at once", yaml: "ANIMATED:\n  WIDTH: 8\n  MAX_FPS: 0\nARTIST_SQUARE:\n  JPEG_QUALITY: 101\n", want: []string{
+			"ANIMATED.WIDTH must be between", "ANIMATED.MAX_FPS must be between", "ARTIST_SQUARE.JPEG_QUALITY must be between",
+		}},
+		{name: "out of range from env", env: map[string]string{"OUTBOUND_MAX_REDIRECTS": "50"}, want: []string{"OUTBOUND.MAX_REDIRECTS must be between 0 and 20"}},
+		{name: "unparsable env", env: map[string]string{"ANIMATED_WIDTH": "wide"}, want: []string{"invalid ANIMATED_WIDTH"}},
+		{name: "unparsable duration", env: map[string]string{"FETCH_TIMEOUT": "5"}, want: []string{"invalid FETCH_TIMEOUT"}},
+		{name: "out of range from a flag", args: []string{"--fetch-concurrency", "0"}, want: []string{"FETCH.CONCURRENCY must be at least 1"}},
+		{name: "unparsable flag", args: []string{"--fetch-retries", "many"}, want: []string{"invalid --fetch-retries"}},
+		{name: "unknown flag", args: []string{"--bogus"}, want: []string{"flag provided but not defined"}},
+		{name: "unknown enum", yaml: "QUEUE:\n  BACKEND: postgres\n", want: []string{`QUEUE.BACKEND must be memory, disk or redis, got "postgres"`}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfigFile(t, tt.yaml)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := loadConfig(tt.args)
+			if err == nil {
+				t.Fatal("loaded without error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't contain %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+ * Configuration reloading
+ *
+ * The config file is polled for changes and reloaded on SIGHUP. A reload
+ * resolves the configuration exactly like startup does (so environment
+ * variables and flags still take precedence) and swaps it in as a whole. A
+ * config that fails validation is rejected and the current one stays live.
+ */
+
+const configPollInterval = 2 * time.Second
+
+// watchConfig reloads the configuration whenever the config file changes or
+// the process receives SIGHUP, until ctx is done. args are the command-line
+// arguments the configuration was originally loaded with.
+func watchConfig(ctx context.Context, args []string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	path := currentConfig().path
+	version := configFileVersion(path)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("Received SIGHUP, reloading configuration")
+			version = configFileVersion(path)
+			reloadConfig(args)
+		case <-ticker.C:
+			if v := configFileVersion(path); v != version {
+				logger.Infof("Config file %s changed, reloading configuration", path)
+				version = v
+				reloadConfig(args)
+			}
+		}
+	}
+}
+
+// configFileVersion identifies the current contents of the config file well
+// enough to notice edits, without reading it.
+func configFileVersion(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+func reloadConfig(args []string) {
+	old := currentConfig()
+	next, err := loadConfig(args)
+	if err != nil {
+		logger.Errorf("Rejected configuration reload, keeping the current configuration: %v", err)
+		return
+	}
+
+	// These are only read at startup, changing them needs a restart
+	if next.ListenAddr != old.ListenAddr {
+		logger.Warnf("LISTEN_ADDR changed, restart to apply")
+		next.ListenAddr = old.ListenAddr
+	}
+	if next.CacheDir != old.CacheDir {
+		logger.Warnf("CACHE_DIR changed, restart to apply")
+		next.CacheDir = old.CacheDir
+	}
+	if !reflect.DeepEqual(next.Queue, old.Queue) {
+		logger.Warnf("QUEUE changed, restart to apply")
+		next.Queue = old.Queue
+	}
+	if next.Fetch.MaxConnsPerHost != old.Fetch.MaxConnsPerHost {
+		logger.Warnf("FETCH.MAX_CONNS_PER_HOST changed, restart to apply")
+		next.Fetch.MaxConnsPerHost = old.Fetch.MaxConnsPerHost
+	}
+
+	changes := diffConfig(reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem(), nil)
+	if len(changes) == 0 {
+		logger.Info("Configuration reloaded, nothing changed")
+		return
+	}
+
+	liveConfig.Store(next)
+	logger.Infof("Configuration reloaded: %s", strings.Join(changes, ", "))
+}
+
+// diffConfig lists the settings that differ between old and next as
+// "PATH: old -> new".
+func diffConfig(old, next reflect.Value, path []string) []string {
+	var changes []string
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), field.Tag.Get("yaml"))
+
+		if field.Type.Kind() == reflect.Struct {
+			changes = append(changes, diffConfig(old.Field(i), next.Field(i), fieldPath)...)
+			continue
+		}
+		if !reflect.DeepEqual(old.Field(i).Interface(), next.Field(i).Interface()) {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", strings.Join(fieldPath, "."), old.Field(i).Interface(), next.Field(i).Interface()))
+		}
+	}
+	return changes
+}
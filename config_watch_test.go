@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	configFile := useConfigFile(t, "ANIMATED:\n  WIDTH: 256\n")
+	config, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveConfig.Store(config)
+
+	rewrite := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rewrite("ANIMATED:\n  WIDTH: 300\n")
+	reloadConfig(nil)
+	if width := currentConfig().Animated.Width; width != 300 {
+		t.Fatalf("ANIMATED.WIDTH = %d after reloading, want 300", width)
+	}
+
+	// Configurations that don't load leave the live one alone
+	live := currentConfig()
+	for _, contents := range []string{
+		"ANIMATED:\n  WIDTH: 8\n",
+		"ANIMATED:\n  WIDHT: 400\n",
+		"ANIMATED: [\n",
+	} {
+		rewrite(contents)
+		reloadConfig(nil)
+		if currentConfig() != live {
+			t.Errorf("reloading %q replaced the configuration", contents)
+		}
+	}
+
+	// Environment variables still win over the file
+	t.Setenv("ANIMATED_MAX_FPS", "12")
+	rewrite("ANIMATED:\n  WIDTH: 300\n  MAX_FPS: 24\n")
+	reloadConfig(nil)
+	if fps := currentConfig().Animated.MaxFPS; fps != 12 {
+		t.Errorf("ANIMATED.MAX_FPS = %d, want the environment's 12", fps)
+	}
+
+	// Settings only read at startup keep their value until a restart
+	rewrite("LISTEN_ADDR: 127.0.0.1:9999\nQUEUE:\n  BACKEND: memory\nANIMATED:\n  WIDTH: 320\n")
+	reloadConfig(nil)
+	if cfg := currentConfig(); cfg.ListenAddr != config.ListenAddr || cfg.Queue.Backend != config.Queue.Backend || cfg.Animated.Width != 320 {
+		t.Errorf("after changing restart-only settings: LISTEN_ADDR %s, QUEUE.BACKEND %s, ANIMATED.WIDTH %d",
+			cfg.ListenAddr, cfg.Queue.Backend, cfg.Animated.Width)
+	}
+}
+
+func TestConfigFileVersion(t *testing.T) {
+	configFile := useConfigFile(t, "ANIMATED:\n  WIDTH: 256\n")
+	version := configFileVersion(configFile)
+	if version == "" || configFileVersion(configFile) != version {
+		t.Fatalf("version %q isn't stable", version)
+	}
+
+	// Same size, later modification time
+	os.WriteFile(configFile, []byte("ANIMATED:\n  WIDTH: 512\n"), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(configFile, later, later)
+	if configFileVersion(configFile) == version {
+		t.Error("edit went unnoticed")
+	}
+
+	if v := configFileVersion(configFile + ".missing"); v != "" {
+		t.Errorf("missing file has version %q", v)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	old, next := defaultConfig(), defaultConfig()
+	next.Animated.Width = 256
+	next.Fetch.Retries = 5
+	changes := diffConfig(reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem(), nil)
+	if got := strings.Join(changes, ", "); got != "FETCH.RETRIES: 3 -> 5, ANIMATED.WIDTH: 486 -> 256" {
+		t.Errorf("changes = %q", got)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * Source fetcher
+ *
+ * Source images are fetched through the shared sourceTransport, so every job
+ * reuses the same pooled connections to each source host. A fetch that fails
+ * for a reason that might go away (a connection error, a 5xx, 408 or 429) is
+ * retried with exponential backoff; anything the URL policy, the network
+ * rules or the DOWNLOAD limits reject fails straight away.
+ *
+ * Responses with an ETag are kept in the source cache, keyed by URL and
+ * ETag. The next fetch of the URL asks for it with If-None-Match, and a 304
+ * is answered from the cache instead of downloading the image again.
+ */
+
+// StatusError is returned when a source responds with anything but 200.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded %s", e.URL, e.Status)
+}
+
+// retryable reports whether fetching again might succeed where err failed.
+func retryable(err error) bool {
+	var rejected *URLRejectedError
+	var tooLarge *ImageTooLargeError
+	var status *StatusError
+	switch {
+	case errors.As(err, &rejected), errors.Is(err, ErrForbiddenAddress), errors.As(err, &tooLarge):
+		return false
+	case errors.As(err, &status):
+		return status.StatusCode >= 500 || status.StatusCode == http.StatusRequestTimeout || status.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// errAttemptTimeout is the cause of a single attempt running out of
+// FETCH.TIMEOUT, as opposed to the job itself running out of time.
+var errAttemptTimeout = errors.New("fetch attempt timed out")
+
+// fetchSource returns the body of the source image at rawURL, fetched under
+// endpoint's URL policy, retrying as FETCH allows.
+func fetchSource(ctx context.Context, endpoint, rawURL string) ([]byte, error) {
+	cfg := currentConfig().Fetch
+	wait := cfg.RetryWait
+	for attempt := 0; ; attempt++ {
+		data, err := fetchSourceOnce(ctx, endpoint, rawURL)
+		if err == nil {
+			return data, nil
+		}
+		if attempt >= cfg.Retries || ctx.Err() != nil || !retryable(err) {
+			sourceFetches.inc("failed")
+			return nil, err
+		}
+
+		logger.Debugf("Fetching %s failed, retrying in %s: %v", rawURL, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			sourceFetches.inc("failed")
+			return nil, ctx.Err()
+		}
+		wait = min(wait*2, cfg.RetryMaxWait)
+	}
+}
+
+func fetchSourceOnce(ctx context.Context, endpoint, rawURL string) ([]byte, error) {
+	cfg := currentConfig()
+	ctx, cancel := context.WithTimeoutCause(ctx, cfg.Fetch.Timeout, errAttemptTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "AniArt/1.0")
+
+	cached := readCachedSource(rawURL)
+	if cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := sourceClient(endpoint).Do(req)
+	if err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, errAttemptTimeout) {
+			return nil, fmt.Errorf("%w after %s", cause, cfg.Fetch.Timeout)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	limits := cfg.Download
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached.data != nil:
+		// Still checked, the limits may have been lowered since
+		if len(cached.data) > limits.MaxBytes {
+			return nil, &ImageTooLargeError{URL: rawURL, Reason: fmt.Sprintf("%d bytes, the limit is %d", len(cached.data), limits.MaxBytes)}
+		}
+		sourceFetches.inc("cached")
+		return cached.data, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, &StatusError{URL: rawURL, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	if resp.ContentLength > int64(limits.MaxBytes) {
+		return nil, &ImageTooLargeError{URL: rawURL, Reason: fmt.Sprintf("%d bytes, the limit is %d", resp.ContentLength, limits.MaxBytes)}
+	}
+
+	// Read one byte past the limit so a body without a Content-Length that
+	// is too long can be told apart from one that is exactly at the limit
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(limits.MaxBytes)+1))
+	if err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, errAttemptTimeout) {
+			return nil, fmt.Errorf("failed to read image data: %w after %s", cause, cfg.Fetch.Timeout)
+		}
+		return nil, fmt.Errorf("failed to read image data: %w", err)
+	}
+	if len(data) > limits.MaxBytes {
+		return nil, &ImageTooLargeError{URL: rawURL, Reason: fmt.Sprintf("more than %d bytes", limits.MaxBytes)}
+	}
+	sourceFetches.inc("downloaded")
+
+	if etag := resp.Header.Get("ETag"); etag != "" && len(data) > 0 {
+		if err := writeCachedSource(rawURL, etag, data); err != nil {
+			logger.Warnf("Failed to cache %s: %v", rawURL, err)
+		}
+	}
+	return data, nil
+}
+
+// cachedSource is the source cache's entry for a URL: the ETag of the copy
+// it holds. data is only set if that copy could be read.
+type cachedSource struct {
+	URL  string `json:"url"`
+	ETag string `json:"etag"`
+	data []byte
+}
+
+// sourceCachePaths returns where the entry for rawURL is kept, and where
+// the copy with etag is.
+func sourceCachePaths(rawURL, etag string) (entry, data string) {
+	key := generateKey(rawURL)
+	return filepath.Join(sources, key+".json"), filepath.Join(sources, generateKey(key+"\n"+etag)+".data")
+}
+
+// readCachedSource returns the cached copy of rawURL, or an empty entry if
+// there is none or FETCH.CACHE is off.
+func readCachedSource(rawURL string) cachedSource {
+	if !currentConfig().Fetch.Cache {
+		return cachedSource{}
+	}
+	entryPath, _ := sourceCachePaths(rawURL, "")
+	var entry cachedSource
+	raw, err := os.ReadFile(entryPath)
+	if err != nil {
+		return cachedSource{}
+	}
+	// Hash collisions aside, an entry for another URL is as good as none
+	if err := json.Unmarshal(raw, &entry); err != nil || entry.URL != rawURL {
+		return cachedSource{}
+	}
+
+	_, dataPath := sourceCachePaths(rawURL, entry.ETag)
+	if entry.data, err = os.ReadFile(dataPath); err != nil {
+		return cachedSource{}
+	}
+	// Kept by pruneSourceCache as long as it's used
+	now := time.Now()
+	os.Chtimes(entryPath, now, now)
+	os.Chtimes(dataPath, now, now)
+	return entry
+}
+
+// writeCachedSource stores data as the copy of rawURL with etag. The data is
+// written before the entry pointing at it, so readers never find an entry
+// without its data.
+func writeCachedSource(rawURL, etag string, data []byte) error {
+	if !currentConfig().Fetch.Cache {
+		return nil
+	}
+	entryPath, dataPath := sourceCachePaths(rawURL, etag)
+	entry, err := json.Marshal(cachedSource{URL: rawURL, ETag: etag})
+	if err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		path string
+		data []byte
+	}{{dataPath, data}, {entryPath, entry}} {
+		// The same URL may be downloaded by several jobs at once
+		tmp, err := os.CreateTemp(sources, strings.TrimSuffix(filepath.Base(file.path), filepath.Ext(file.path))+"_temp.*")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(file.data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), file.path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneSourceCache removes cached sources that haven't been used for
+// FETCH.CACHE_MAX_AGE, including copies whose ETag has been superseded.
+func pruneSourceCache() {
+	maxAge := currentConfig().Fetch.CacheMaxAge
+	if maxAge == 0 {
+		return
+	}
+	entries, err := os.ReadDir(sources)
+	if err != nil {
+		logger.Errorf("Error listing source cache: %v", err)
+		return
+	}
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(sources, entry.Name())); err != nil {
+			logger.Errorf("Failed to remove cached source %s: %v", entry.Name(), err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		logger.Infof("Removed %d unused files from the source cache", removed)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sourceServer serves source images and records when each path was asked
+// for, and with which If-None-Match.
+type sourceServer struct {
+	*httptest.Server
+	mu          sync.Mutex
+	attempts    map[string][]time.Time
+	revalidated []string
+	// failures is how many times a path responds 503 before it succeeds
+	failures map[string]int
+	etag     string
+}
+
+func newSourceServer(t *testing.T) *sourceServer {
+	t.Helper()
+	srv := &sourceServer{attempts: make(map[string][]time.Time), failures: make(map[string]int), etag: `"v1"`}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		srv.attempts[r.URL.Path] = append(srv.attempts[r.URL.Path], time.Now())
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case srv.failures[r.URL.Path] != 0:
+			// Negative fails forever
+			srv.failures[r.URL.Path]--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		case r.Header.Get("If-None-Match") != "":
+			srv.revalidated = append(srv.revalidated, r.Header.Get("If-None-Match"))
+			if r.Header.Get("If-None-Match") == srv.etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fallthrough
+		default:
+			w.Header().Set("ETag", srv.etag)
+			w.Write([]byte("image " + srv.etag))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := defaultConfig()
+	cfg.URLPolicy = URLPolicyConfig{Schemes: []string{"http"}, Hosts: []string{"127.0.0.1"}, Ports: []int{serverPort(t, srv.Server)}}
+	cfg.Outbound.AllowedNetworks = []string{"127.0.0.1/32"}
+	liveConfig.Store(cfg)
+
+	saved := sources
+	sources = t.TempDir()
+	t.Cleanup(func() { sources = saved })
+	return srv
+}
+
+func (s *sourceServer) attemptTimes(path string) []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[path]
+}
+
+// counted returns how many fetches with result were counted while fetch ran.
+func counted(fetch func(), results ...string) map[string]uint64 {
+	read := func() map[string]uint64 {
+		sourceFetches.mu.Lock()
+		defer sourceFetches.mu.Unlock()
+		values := make(map[string]uint64)
+		for _, result := range results {
+			values[result] = sourceFetches.values[result]
+		}
+		return values
+	}
+	before := read()
+	fetch()
+	after := read()
+	for result := range after {
+		after[result] -= before[result]
+	}
+	return after
+}
+
+func TestFetchSourceRetries(t *testing.T) {
+	srv := newSourceServer(t)
+	cfg := currentConfig()
+	cfg.Fetch.Cache = false
+	cfg.Fetch.Retries = 4
+	cfg.Fetch.RetryWait = 20 * time.Millisecond
+	cfg.Fetch.RetryMaxWait = 40 * time.Millisecond
+	srv.failures["/flaky"] = 4
+	srv.failures["/down"] = -1
+
+	for _, tt := range []struct {
+		path     string
+		attempts int
+		// waits are the least time between attempts
+		waits  []time.Duration
+		result string
+	}{
+		// Backs off 20, 40, then stays at RETRY_MAX_WAIT rather than 80, 160
+		{path: "/flaky", attempts: 5, waits: []time.Duration{20, 40, 40, 40}, result: "downloaded"},
+		{path: "/down", attempts: 5, result: "failed"},
+		// Retrying can't help a 404
+		{path: "/missing", attempts: 1, result: "failed"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			var err error
+			counts := counted(func() {
+				_, err = fetchSource(context.Background(), endpointArtistSquare, srv.URL+tt.path)
+			}, "downloaded", "cached", "failed")
+			if (tt.result == "failed") != (err != nil) {
+				t.Errorf("err = %v", err)
+			}
+			if counts[tt.result] != 1 || counts["downloaded"]+counts["cached"]+counts["failed"] != 1 {
+				t.Errorf("counted %v, want one %s", counts, tt.result)
+			}
+
+			times := srv.attemptTimes(tt.path)
+			if len(times) != tt.attempts {
+				t.Fatalf("%d attempts, want %d", len(times), tt.attempts)
+			}
+			for i, least := range tt.waits {
+				wait := times[i+1].Sub(times[i])
+				// Generous on the upper end, machines stall, but short of
+				// the doubled wait there would be without the cap
+				if wait < least*time.Millisecond || wait > least*time.Millisecond*7/4 {
+					t.Errorf("waited %s before attempt %d, want %dms", wait, i+2, least)
+				}
+			}
+		})
+	}
+
+	var status *StatusError
+	_, err := fetchSource(context.Background(), endpointArtistSquare, srv.URL+"/missing")
+	if !errors.As(err, &status) || status.StatusCode != http.StatusNotFound {
+		t.Errorf("err = %v, want a 404 StatusError", err)
+	}
+}
+
+func TestFetchSourceRevalidates(t *testing.T) {
+	srv := newSourceServer(t)
+	currentConfig().Fetch.Cache = true
+	url := srv.URL + "/image"
+
+	fetch := func(want string) map[string]uint64 {
+		t.Helper()
+		var data []byte
+		var err error
+		counts := counted(func() {
+			data, err = fetchSource(context.Background(), endpointArtistSquare, url)
+		}, "downloaded", "cached")
+		if err != nil || string(data) != want {
+			t.Fatalf("got %q, %v, want %q", data, err, want)
+		}
+		return counts
+	}
+
+	if counts := fetch(`image "v1"`); counts["downloaded"] != 1 {
+		t.Errorf("first fetch counted %v, want a download", counts)
+	}
+	if counts := fetch(`image "v1"`); counts["cached"] != 1 {
+		t.Errorf("second fetch counted %v, want a cache hit", counts)
+	}
+
+	// A new version replaces the cached one
+	srv.mu.Lock()
+	srv.etag = `"v2"`
+	srv.mu.Unlock()
+	if counts := fetch(`image "v2"`); counts["downloaded"] != 1 {
+		t.Errorf("changed image counted %v, want a download", counts)
+	}
+	if counts := fetch(`image "v2"`); counts["cached"] != 1 {
+		t.Errorf("fetch after the change counted %v, want a cache hit", counts)
+	}
+
+	srv.mu.Lock()
+	revalidated := strings.Join(srv.revalidated, " ")
+	srv.mu.Unlock()
+	if revalidated != `"v1" "v1" "v2"` {
+		t.Errorf("revalidated with %s", revalidated)
+	}
+
+	// Without the cache nothing is revalidated
+	currentConfig().Fetch.Cache = false
+	if counts := fetch(`image "v2"`); counts["downloaded"] != 1 {
+		t.Errorf("fetch without the cache counted %v, want a download", counts)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.revalidated) != 3 {
+		t.Errorf("revalidated without the cache: %v", srv.revalidated)
+	}
+}
+
+func TestPruneSourceCache(t *testing.T) {
+	newSourceServer(t)
+	cfg := currentConfig()
+	cfg.Fetch.Cache = true
+	cfg.Fetch.CacheMaxAge = time.Hour
+
+	for _, url := range []string{"https://a.test/old.jpg", "https://a.test/new.jpg"} {
+		if err := writeCachedSource(url, `"v1"`, []byte("image")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, etag := range []string{"", `"v1"`} {
+		entry, data := sourceCachePaths("https://a.test/old.jpg", etag)
+		os.Chtimes(entry, old, old)
+		os.Chtimes(data, old, old)
+	}
+
+	// 0 keeps everything
+	cfg.Fetch.CacheMaxAge = 0
+	pruneSourceCache()
+	if files, _ := filepath.Glob(filepath.Join(sources, "*")); len(files) != 4 {
+		t.Fatalf("CACHE_MAX_AGE 0 left %d files, want 4", len(files))
+	}
+
+	cfg.Fetch.CacheMaxAge = time.Hour
+	pruneSourceCache()
+	if cached := readCachedSource("https://a.test/old.jpg"); cached.data != nil {
+		t.Error("unused source was kept")
+	}
+	if cached := readCachedSource("https://a.test/new.jpg"); string(cached.data) != "image" {
+		t.Error("recently used source was removed")
+	}
+	if files, _ := filepath.Glob(filepath.Join(sources, "*")); len(files) != 2 {
+		t.Errorf("%d files left, want 2", len(files))
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+/*
+ * Output formats
+ *
+ * Everything that differs between preset FORMATs: how they're encoded,
+ * stored, served and checked. The animated artwork pipeline is the same for
+ * all of them, so a new format only needs an entry in outputFormats.
+ */
+
+// outputFormat describes one preset FORMAT.
+type outputFormat struct {
+	name string
+	// label names the format in responses
+	label string
+	// ext is the extension the file is stored and served with
+	ext         string
+	contentType string
+	// taskType is the job type that generates the format, see registerJobHandlers
+	taskType string
+	// Video formats are looped by the player rather than the file, and
+	// need an even height
+	video bool
+	// filters are appended to the filter chain, after the preset's own
+	filters string
+	// args are the output options every preset in the format needs,
+	// regardless of what the preset itself says
+	args ffmpeg.KwArgs
+	// quality is the encoder option PRESETS.QUALITY sets, "" if it has none
+	quality string
+	// loopArgs returns the output options for a loop count, see
+	// AnimatedParams.Loop. Nil leaves the loop count out.
+	loopArgs func(loop int) ffmpeg.KwArgs
+}
+
+// outputFormats are all the formats animated artwork can be generated in.
+// The order is the one getArtwork prefers when the client accepts anything.
+var outputFormats = []*outputFormat{
+	{
+		name: "gif", label: "GIF", ext: "gif", contentType: "image/gif",
+		taskType: TypeGenerateArtwork,
+		filters:  "split[s0][s1];[s0]palettegen[p];[s1][p]paletteuse",
+		loopArgs: repeatLoop("loop"),
+	},
+	{
+		name: "webp", label: "WEBP", ext: "webp", contentType: "image/webp",
+		taskType: TypeGenerateAltArtwork,
+		quality:  "quality",
+		// The webp muxer counts plays like avif, not repeats like gif
+		loopArgs: playsLoop("loop"),
+	},
+	{
+		name: "mp4", label: "Video", ext: "mp4", contentType: "video/mp4",
+		taskType: TypeGenerateVideoArtwork,
+		video:    true,
+		// faststart moves the index to the front so playback can start
+		// before the whole file has been downloaded
+		args: ffmpeg.KwArgs{"an": "", "pix_fmt": "yuv420p", "movflags": "+faststart"},
+	},
+	{
+		name: "avif", label: "AVIF", ext: "avif", contentType: "image/avif",
+		taskType: TypeGenerateAltArtwork,
+		args:     ffmpeg.KwArgs{"pix_fmt": "yuv420p", "f": "avif"},
+		loopArgs: playsLoop("loop"),
+	},
+	{
+		name: "apng", label: "APNG", ext: "apng", contentType: "image/apng",
+		taskType: TypeGenerateAltArtwork,
+		args:     ffmpeg.KwArgs{"f": "apng"},
+		loopArgs: playsLoop("plays"),
+	},
+	{
+		// Stored as .mp4, the container is the same as H.264's
+		name: "hevc", label: "Video", ext: "mp4", contentType: "video/mp4",
+		taskType: TypeGenerateVideoArtwork,
+		video:    true,
+		// hvc1 rather than hev1 is what Apple devices play
+		args: ffmpeg.KwArgs{"an": "", "pix_fmt": "yuv420p", "tag:v": "hvc1", "f": "mp4",
+			"movflags": "+frag_keyframe+empty_moov+default_base_moof"},
+	},
+}
+
+// servedFormats are the outputFormats with distinct extensions, the kinds of
+// file getArtwork looks for.
+var servedFormats = func() []*outputFormat {
+	var served []*outputFormat
+	seen := map[string]bool{}
+	for _, f := range outputFormats {
+		if !seen[f.ext] {
+			seen[f.ext] = true
+			served = append(served, f)
+		}
+	}
+	return served
+}()
+
+// lookupFormat returns the format called name, or nil if there is none.
+func lookupFormat(name string) *outputFormat {
+	for _, f := range outputFormats {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// formatNames returns the names of all outputFormats.
+func formatNames() []string {
+	names := make([]string, len(outputFormats))
+	for i, f := range outputFormats {
+		names[i] = f.name
+	}
+	return names
+}
+
+// repeatLoop sets option to the loop count as is, the number of repeats.
+func repeatLoop(option string) func(int) ffmpeg.KwArgs {
+	return func(loop int) ffmpeg.KwArgs {
+		return ffmpeg.KwArgs{option: strconv.Itoa(loop)}
+	}
+}
+
+// playsLoop sets option to the number of plays rather than repeats, still
+// with 0 for forever.
+func playsLoop(option string) func(int) ffmpeg.KwArgs {
+	return func(loop int) ffmpeg.KwArgs {
+		plays := loop + 1
+		switch loop {
+		case 0:
+			plays = 0
+		case -1:
+			plays = 1
+		}
+		return ffmpeg.KwArgs{option: strconv.Itoa(plays)}
+	}
+}
+
+// path returns where the artwork with key is stored in the format.
+func (f *outputFormat) path(key string) string {
+	return filepath.Join(animatedArt, fmt.Sprintf("%s.%s", key, f.ext))
+}
+
+// url returns the published URL of the artwork with key in the format.
+func (f *outputFormat) url(key string) string {
+	return fmt.Sprintf("%s/artwork/%s.%s", currentConfig().PublishedURI, key, f.ext)
+}
+
+// detectAnimatedFormat returns the format of the file starting with header:
+// gif, webp, png, apng, avif or mp4, or "" if it isn't any of them. HEVC in
+// MP4 is reported as mp4, the container doesn't say which codec it holds.
+func detectAnimatedFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return "gif"
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return detectPNG(header[8:])
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		switch string(header[8:12]) {
+		case "avif", "avis":
+			return "avif"
+		default:
+			return "mp4"
+		}
+	}
+	return ""
+}
+
+// detectPNG tells APNG from plain PNG by walking the chunks. An APNG has an
+// acTL chunk before its first IDAT.
+func detectPNG(chunks []byte) string {
+	for len(chunks) >= 8 {
+		length := binary.BigEndian.Uint32(chunks[0:4])
+		switch string(chunks[4:8]) {
+		case "acTL":
+			return "apng"
+		case "IDAT":
+			return "png"
+		}
+		// Length, type, data and CRC
+		if uint64(length)+12 > uint64(len(chunks)) {
+			break
+		}
+		chunks = chunks[length+12:]
+	}
+	return "png"
+}
+
+// check makes sure the file at path is what the format should have produced,
+// so a misconfigured preset can't store something else under the format's
+// extension.
+func (f *outputFormat) check(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := make([]byte, 64*1024)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	if detected := detectAnimatedFormat(header[:n]); detected != f.ext {
+		return fmt.Errorf("ffmpeg produced %q instead of %s", detected, f.name)
+	}
+	return nil
+}
+
+// checkMedia makes sure probed output in the format has the size that was
+// asked for and stays within ANIMATED.OUTPUT.
+func (f *outputFormat) checkMedia(info MediaInfo, params AnimatedParams) error {
+	limits := currentConfig().Animated.Output
+	switch {
+	case info.Width != params.Width || info.Height <= 0:
+		return fmt.Errorf("output is %dx%d, expected %d pixels wide", info.Width, info.Height, params.Width)
+	case f.video && info.Height%2 != 0:
+		return fmt.Errorf("output height %d is odd, video encoders need it even", info.Height)
+	case info.Frames < 1:
+		return fmt.Errorf("output has no frames")
+	case info.Frames > limits.MaxFrames:
+		return fmt.Errorf("output has %d frames, more than the limit of %d", info.Frames, limits.MaxFrames)
+	case info.Bytes > int64(limits.MaxBytes):
+		return fmt.Errorf("output is %d bytes, more than the limit of %d", info.Bytes, limits.MaxBytes)
+	}
+	return nil
+}
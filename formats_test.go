@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+func TestDetectAnimatedFormat(t *testing.T) {
+	var still bytes.Buffer
+	if err := png.Encode(&still, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	signature := []byte("\x89PNG\r\n\x1a\n")
+	ihdr := pngChunk("IHDR", make([]byte, 13))
+
+	for _, tt := range []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"GIF87a", []byte("GIF87a..."), "gif"},
+		{"GIF89a", []byte("GIF89a..."), "gif"},
+		{"WebP", []byte("RIFF\x10\x00\x00\x00WEBPVP8X"), "webp"},
+		{"RIFF that isn't WebP", []byte("RIFF\x10\x00\x00\x00WAVEfmt "), ""},
+		{"AVIF", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), "avif"},
+		{"AVIF sequence", []byte("\x00\x00\x00\x1cftypavis\x00\x00\x00\x00"), "avif"},
+		{"MP4", []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00"), "mp4"},
+		{"still PNG", still.Bytes(), "png"},
+		{"APNG", concat(signature, ihdr, pngChunk("acTL", make([]byte, 8)), pngChunk("IDAT", nil)), "apng"},
+		{"acTL after IDAT", concat(signature, ihdr, pngChunk("IDAT", nil), pngChunk("acTL", make([]byte, 8))), "png"},
+		{"truncated chunk", concat(signature, ihdr[:10]), "png"},
+		{"chunk longer than the header", concat(signature, []byte("\xff\xff\xff\xffIHDR")), "png"},
+		{"JPEG", []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), ""},
+		{"short", []byte("GIF"), ""},
+		{"empty", nil, ""},
+	} {
+		if got := detectAnimatedFormat(tt.header); got != tt.want {
+			t.Errorf("%s: detected %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestFormatCheckFFmpeg encodes a short test pattern with every format's
+// default preset and makes sure check accepts the result.
+func TestFormatCheckFFmpeg(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	liveConfig.Store(defaultConfig())
+	dir := t.TempDir()
+
+	for _, format := range outputFormats {
+		t.Run(format.name, func(t *testing.T) {
+			preset := defaultPresets[defaultPresetFor(format.name)]
+			params := defaultAnimatedParams(format.name, preset)
+			params.Width = 64
+			output := filepath.Join(dir, format.name+"."+format.ext)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			stream := ffmpeg.Input("testsrc=size=96x96:rate=5:duration=1", ffmpeg.KwArgs{"f": "lavfi"}).
+				Output(output, ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{preset.outputArgs(format), params.outputArgs(format), {
+					"vf":       params.ffmpegFilters(preset, format),
+					"loglevel": "error",
+				}})).
+				OverWriteOutput()
+			if out, err := exec.CommandContext(ctx, "ffmpeg", stream.GetArgs()...).CombinedOutput(); err != nil {
+				// Not every build has every encoder
+				t.Skipf("ffmpeg can't encode %s here: %v\n%s", format.name, err, out)
+			}
+
+			if err := format.check(output); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	// A single frame is a plain PNG, not an APNG
+	output := filepath.Join(dir, "still.png")
+	cmd := exec.Command("ffmpeg", "-loglevel", "error", "-f", "lavfi", "-i", "testsrc=size=64x64", "-frames:v", "1", "-y", output)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("ffmpeg failed: %v\n%s", err, out)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := detectAnimatedFormat(data); got != "png" {
+		t.Errorf("still PNG detected as %q", got)
+	}
+	if err := lookupFormat("apng").check(output); err == nil {
+		t.Error("still PNG passed the APNG check")
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// TestLoopArgs checks loop means the same in every format: 0 forever, -1
+// plays once and N repeats N times.
+func TestLoopArgs(t *testing.T) {
+	for _, tt := range []struct {
+		format string
+		// want are the options for loop -1, 0 and 2, nil if there are none
+		want []ffmpeg.KwArgs
+	}{
+		{"gif", []ffmpeg.KwArgs{{"loop": "-1"}, {"loop": "0"}, {"loop": "2"}}},
+		{"webp", []ffmpeg.KwArgs{{"loop": "1"}, {"loop": "0"}, {"loop": "3"}}},
+		{"avif", []ffmpeg.KwArgs{{"loop": "1"}, {"loop": "0"}, {"loop": "3"}}},
+		{"apng", []ffmpeg.KwArgs{{"plays": "1"}, {"plays": "0"}, {"plays": "3"}}},
+		{"mp4", nil},
+		{"hevc", nil},
+	} {
+		format := lookupFormat(tt.format)
+		for i, loop := range []int{-1, 0, 2} {
+			args := AnimatedParams{Loop: loop}.outputArgs(format)
+			want := ffmpeg.KwArgs{}
+			if tt.want != nil {
+				want = tt.want[i]
+			}
+			if !reflect.DeepEqual(args, want) {
+				t.Errorf("%s with loop %d: %v, want %v", tt.format, loop, args, want)
+			}
+		}
+	}
+	if len(outputFormats) != 6 {
+		t.Errorf("%d formats, add the new ones here", len(outputFormats))
+	}
+}
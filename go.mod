@@ -3,7 +3,6 @@ module aniart
 go 1.23.0
 
 require (
-	github.com/go-resty/resty/v2 v2.15.2
 	github.com/sirupsen/logrus v1.9.3
 	github.com/u2takey/ffmpeg-go v0.5.0
 	gopkg.in/yaml.v2 v2.4.0
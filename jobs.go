@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// jobMaxAttempts caps how many times a job is started, so a job that keeps
+// taking the process down is not picked up again forever after restarts.
+const jobMaxAttempts = 3
+
+// jobRetention is how long finished jobs stay queryable through /jobs/:id.
+const jobRetention = 24 * time.Hour
+
+// jobTimeout bounds how long a single attempt may run before its downloads
+// and ffmpeg process are killed.
+func jobTimeout(taskType string) time.Duration {
+	switch taskType {
+	case TypeGenerateArtwork, TypeGenerateAltArtwork, TypeGenerateVideoArtwork:
+		return currentConfig().Animated.Timeout
+	case TypeCreateArtistSquare:
+		return currentConfig().ArtistSquare.Timeout
+	case TypeCreateICloudArt:
+		return currentConfig().ICloud.Timeout
+	default:
+		return 2 * time.Minute
+	}
+}
+
+type Job struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	Key         string            `json:"key"`
+	Format      string            `json:"format,omitempty"`
+	Payload     json.RawMessage   `json:"payload"`
+	State       JobState          `json:"state"`
+	Progress    int               `json:"progress"`
+	Attempts    int               `json:"attempts"`
+	ResultURL   string            `json:"result_url,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	ErrorStatus int               `json:"error_status,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	StartedAt   *time.Time        `json:"started_at,omitempty"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+}
+
+// status is the public view of a job, as returned by GET /jobs/:id.
+func (j *Job) status() gin.H {
+	return gin.H{
+		"id":           j.ID,
+		"type":         j.Type,
+		"key":          j.Key,
+		"format":       j.Format,
+		"state":        j.State,
+		"progress":     j.Progress,
+		"attempts":     j.Attempts,
+		"url":          j.ResultURL,
+		"error":        j.Error,
+		"error_status": j.ErrorStatus,
+		"details":      j.Details,
+		"created_at":   j.CreatedAt,
+		"updated_at":   j.UpdatedAt,
+		"started_at":   j.StartedAt,
+		"finished_at":  j.FinishedAt,
+	}
+}
+
+// jobHandler executes a job. On success it sets job.ResultURL to where the
+// artwork can be fetched.
+type jobHandler func(ctx context.Context, job *Job) error
+
+// jobPruner is implemented by queue backends that need to be told to drop
+// finished jobs, backends that expire them by themselves don't implement it.
+type jobPruner interface {
+	Prune(before time.Time) (int, error)
+}
+
+type progressKey struct{}
+
+// reportProgress records how far along the job running under ctx is, as a
+// percentage. It is a no-op outside of a job.
+func reportProgress(ctx context.Context, percent int) {
+	if report, ok := ctx.Value(progressKey{}).(func(int)); ok {
+		report(percent)
+	}
+}
+
+type detailKey struct{}
+
+// reportDetail records a note about how the job running under ctx went, such
+// as which stream it was generated from. It is a no-op outside of a job.
+func reportDetail(ctx context.Context, name, value string) {
+	if report, ok := ctx.Value(detailKey{}).(func(string, string)); ok {
+		report(name, value)
+	}
+}
+
+type jobManager struct {
+	queue    JobQueue
+	handlers map[string]jobHandler
+	workers  map[string]int
+
+	mu       sync.Mutex
+	waiters  map[string][]chan *Job
+	inflight map[string]string // task type + artwork key + format -> job ID
+	wg       sync.WaitGroup
+
+	// stopping is cancelled when workers should stop taking new jobs,
+	// aborting when running jobs should be killed.
+	stopping     context.Context
+	stop         context.CancelFunc
+	aborting     context.Context
+	abort        context.CancelFunc
+	shuttingDown atomic.Bool
+}
+
+var jobs *jobManager
+
+func newJobManager(queue JobQueue, workers map[string]int) *jobManager {
+	m := &jobManager{
+		queue:    queue,
+		handlers: make(map[string]jobHandler),
+		workers:  make(map[string]int),
+		waiters:  make(map[string][]chan *Job),
+		inflight: make(map[string]string),
+	}
+	m.stopping, m.stop = context.WithCancel(context.Background())
+	m.aborting, m.abort = context.WithCancel(context.Background())
+	for taskType, count := range workers {
+		m.workers[taskType] = count
+	}
+	return m
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate job ID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+func (m *jobManager) register(taskType string, handler jobHandler) {
+	m.handlers[taskType] = handler
+}
+
+// start launches the worker pools for every registered task type.
+func (m *jobManager) start() {
+	for taskType := range m.handlers {
+		count := m.workers[taskType]
+		if count < 1 {
+			count = 1
+		}
+		logger.Infof("Starting %d workers for %s", count, taskType)
+		for i := 0; i < count; i++ {
+			m.wg.Add(1)
+			go m.work(taskType)
+		}
+	}
+
+	if pruner, ok := m.queue.(jobPruner); ok {
+		go m.prune(m.stopping, pruner)
+	}
+}
+
+func (m *jobManager) prune(ctx context.Context, pruner jobPruner) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if count, err := pruner.Prune(time.Now().Add(-jobRetention)); err != nil {
+			logger.Errorf("Error pruning finished jobs: %v", err)
+		} else if count > 0 {
+			logger.Infof("Pruned %d finished jobs", count)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// inflightKey identifies the artwork job produces. Several formats share a
+// task type, and may share a key too.
+func inflightKey(job *Job) string {
+	return job.Type + "/" + job.Key + "/" + job.Format
+}
+
+// submit enqueues a job producing the artwork identified by key in format,
+// which is "" for task types with only one format per key, and returns its ID
+// along with a channel that receives the job once it has finished. The
+// channel is buffered so callers are free to stop waiting.
+//
+// If a job for the same task type, key and format is already queued or
+// running, no new job is created: the caller is attached to the existing job,
+// whose ID is returned instead, and id and payload are discarded.
+func (m *jobManager) submit(id, taskType, key, format string, payload interface{}) (string, <-chan *Job, error) {
+	if m.shuttingDown.Load() {
+		return "", nil, ErrShuttingDown
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:        id,
+		Type:      taskType,
+		Key:       key,
+		Format:    format,
+		Payload:   data,
+		State:     JobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	done := make(chan *Job, 1)
+
+	m.mu.Lock()
+	if existingID, ok := m.inflight[inflightKey(job)]; ok {
+		m.waiters[existingID] = append(m.waiters[existingID], done)
+		m.mu.Unlock()
+		jobsCoalesced.inc(taskType)
+		return existingID, done, nil
+	}
+	m.waiters[id] = append(m.waiters[id], done)
+	m.inflight[inflightKey(job)] = id
+	m.mu.Unlock()
+
+	if err := m.queue.Enqueue(job); err != nil {
+		m.mu.Lock()
+		delete(m.waiters, id)
+		delete(m.inflight, inflightKey(job))
+		m.mu.Unlock()
+		return "", nil, fmt.Errorf("failed to enqueue job: %w", err)
+	}
+
+	jobsSubmitted.inc(taskType)
+	return id, done, nil
+}
+
+func (m *jobManager) work(taskType string) {
+	defer m.wg.Done()
+
+	for {
+		job, err := m.queue.Dequeue(m.stopping, taskType)
+		if err != nil {
+			if m.stopping.Err() != nil {
+				return
+			}
+			logger.Errorf("Error dequeuing %s job: %v", taskType, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		m.run(m.aborting, job)
+	}
+}
+
+func (m *jobManager) run(ctx context.Context, job *Job) {
+	job.Attempts++
+	if job.Attempts > jobMaxAttempts {
+		job.State = JobFailed
+		job.Error = fmt.Sprintf("giving up after %d attempts", jobMaxAttempts)
+		m.finish(job)
+		return
+	}
+
+	// Jobs recovered from a previous run were never submitted through this
+	// manager, make sure new requests for the same artwork attach to them.
+	m.mu.Lock()
+	if _, ok := m.inflight[inflightKey(job)]; !ok {
+		m.inflight[inflightKey(job)] = job.ID
+	}
+	m.mu.Unlock()
+
+	now := time.Now()
+	job.State = JobRunning
+	job.Progress = 0
+	job.Error = ""
+	job.ErrorStatus = 0
+	job.StartedAt = &now
+	m.update(job)
+
+	// Progress reports come from the handler's goroutine, the same one that
+	// owns job, so they can update it directly.
+	ctx = context.WithValue(ctx, progressKey{}, func(percent int) {
+		if percent > job.Progress && percent < 100 {
+			job.Progress = percent
+			m.update(job)
+		}
+	})
+	ctx = context.WithValue(ctx, detailKey{}, func(name, value string) {
+		// Copy rather than modify, the memory queue shares the map with
+		// whatever it has handed out
+		details := maps.Clone(job.Details)
+		if details == nil {
+			details = make(map[string]string)
+		}
+		details[name] = value
+		job.Details = details
+		m.update(job)
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, jobTimeout(job.Type))
+	defer cancel()
+
+	err := m.handlers[job.Type](ctx, job)
+	if err != nil && m.aborting.Err() != nil {
+		// Killed by shutdown, leave the job queued for the next start rather
+		// than failing it or counting the attempt.
+		logger.Warnf("Job %s (%s) interrupted by shutdown", job.ID, job.Type)
+		job.State = JobQueued
+		job.Attempts--
+		job.StartedAt = nil
+		m.update(job)
+		return
+	} else if err != nil {
+		logger.Errorf("Job %s (%s) failed: %v", job.ID, job.Type, err)
+		job.State = JobFailed
+		job.Error = err.Error()
+		job.ErrorStatus = jobErrorStatus(err)
+	} else {
+		job.State = JobSucceeded
+		job.Progress = 100
+	}
+	m.finish(job)
+}
+
+func (m *jobManager) update(job *Job) {
+	job.UpdatedAt = time.Now()
+	if err := m.queue.Update(job); err != nil {
+		logger.Errorf("Error updating job %s: %v", job.ID, err)
+	}
+}
+
+func (m *jobManager) finish(job *Job) {
+	now := time.Now()
+	job.FinishedAt = &now
+	job.UpdatedAt = now
+	if err := m.queue.Update(job); err != nil {
+		logger.Errorf("Error updating job %s: %v", job.ID, err)
+	}
+
+	m.mu.Lock()
+	waiters := m.waiters[job.ID]
+	delete(m.waiters, job.ID)
+	if m.inflight[inflightKey(job)] == job.ID {
+		delete(m.inflight, inflightKey(job))
+	}
+	m.mu.Unlock()
+
+	jobsFinished.inc(job.Type, string(job.State))
+
+	for _, done := range waiters {
+		result := *job
+		done <- &result
+	}
+}
+
+// shutdown stops workers from taking new jobs and waits for running jobs to
+// finish. Jobs still running when ctx is done are killed and left queued, so
+// queue backends that persist jobs pick them up again on the next start.
+func (m *jobManager) shutdown(ctx context.Context) error {
+	m.shuttingDown.Store(true)
+	m.stop()
+
+	drained := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		logger.Warnf("Shutdown deadline reached, killing running jobs")
+		m.abort()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+/*
+ * Task handlers
+ */
+
+func registerJobHandlers(m *jobManager) {
+	// Every animated format runs the same pipeline, the task types only keep
+	// their workers apart. Jobs queued before there were parameters get the
+	// one format their type used to produce.
+	for taskType, defaultFormat := range map[string]string{
+		TypeGenerateArtwork:      "gif",
+		TypeGenerateAltArtwork:   "webp",
+		TypeGenerateVideoArtwork: "mp4",
+	} {
+		m.register(taskType, func(ctx context.Context, job *Job) error {
+			var payload GenerateArtworkPayload
+			if err := json.Unmarshal(job.Payload, &payload); err != nil {
+				return fmt.Errorf("invalid payload: %w", err)
+			}
+			params := payload.animatedParams(defaultFormat)
+			if err := generateAnimatedArtworkAsync(ctx, payload.URL, payload.Key, params); err != nil {
+				return err
+			}
+			job.ResultURL = lookupFormat(params.Format).url(payload.Key)
+			return nil
+		})
+	}
+
+	m.register(TypeCreateArtistSquare, func(ctx context.Context, job *Job) error {
+		var payload CreateArtistSquarePayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+		opts := payload.Options.withDefaults("grid", "strict")
+		if err := generateArtistSquareAsync(ctx, payload.ImageURLs, opts, payload.Key); err != nil {
+			return err
+		}
+		job.ResultURL = lookupSquareFormat(opts.Format).url(payload.Key)
+		return nil
+	})
+
+	m.register(TypeCreateICloudArt, func(ctx context.Context, job *Job) error {
+		var payload CreateICloudArtPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+		if err := generateICloudArtAsync(ctx, payload.ImageURL, payload.Key); err != nil {
+			return err
+		}
+		iCloudPath := findICloudArt(payload.Key)
+		if iCloudPath == "" {
+			return fmt.Errorf("failed to locate generated iCloud art")
+		}
+		job.ResultURL = fmt.Sprintf("%s/artwork/icloud/%s", currentConfig().PublishedURI, filepath.Base(iCloudPath))
+		return nil
+	})
+}
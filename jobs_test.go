@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSubmitCoalescesPerFormat(t *testing.T) {
+	m := newJobManager(newMemoryQueue(), nil)
+
+	webp, _, err := m.submit(newJobID(), TypeGenerateAltArtwork, "key", "webp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	avif, _, err := m.submit(newJobID(), TypeGenerateAltArtwork, "key", "avif", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _, err := m.submit(newJobID(), TypeGenerateAltArtwork, "key", "webp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if avif == webp {
+		t.Errorf("avif job was attached to the webp job %s", webp)
+	}
+	if again != webp {
+		t.Errorf("second webp job = %s, want it attached to %s", again, webp)
+	}
+}
+
+// useJobs makes jobs a manager on a memory queue running handlers, shut down
+// when the test ends.
+func useJobs(t *testing.T, handlers map[string]jobHandler) *jobManager {
+	t.Helper()
+	m := newJobManager(newMemoryQueue(), nil)
+	for taskType, handler := range handlers {
+		m.register(taskType, handler)
+	}
+	m.start()
+
+	saved := jobs
+	jobs = m
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		m.shutdown(ctx)
+		jobs = saved
+	})
+	return m
+}
+
+func TestShutdownDrainsRunningJobs(t *testing.T) {
+	liveConfig.Store(defaultConfig())
+	q, err := openDiskQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newJobManager(q, nil)
+	started := make(chan struct{})
+	m.register(TypeGenerateArtwork, func(ctx context.Context, job *Job) error {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		job.ResultURL = "done"
+		return nil
+	})
+	m.start()
+
+	id, done, err := m.submit(newJobID(), TypeGenerateArtwork, "key", "gif", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if job := <-done; job.State != JobSucceeded {
+		t.Errorf("drained job is %s", job.State)
+	}
+	if job, err := q.Get(id); err != nil || job.State != JobSucceeded || job.ResultURL != "done" {
+		t.Errorf("stored job = %+v, %v", job, err)
+	}
+	if _, _, err := m.submit(newJobID(), TypeGenerateArtwork, "other", "gif", nil); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("submit after shutdown: %v", err)
+	}
+}
+
+func TestShutdownLeavesKilledJobsQueued(t *testing.T) {
+	liveConfig.Store(defaultConfig())
+	dir := t.TempDir()
+	q, err := openDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newJobManager(q, nil)
+	started := make(chan struct{})
+	m.register(TypeGenerateArtwork, func(ctx context.Context, job *Job) error {
+		close(started)
+		reportProgress(ctx, 40)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	m.start()
+
+	id, done, err := m.submit(newJobID(), TypeGenerateArtwork, "key", "gif", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// Like SHUTDOWN_TIMEOUT running out
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown: %v, want the deadline", err)
+	}
+
+	job, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobQueued || job.Attempts != 0 || job.StartedAt != nil || job.FinishedAt != nil || job.Error != "" {
+		t.Errorf("killed job = %+v, want it queued as if it never ran", job)
+	}
+	select {
+	case job := <-done:
+		t.Errorf("waiter was told the killed job finished as %s", job.State)
+	default:
+	}
+
+	// And it runs again on the next start
+	q, err = openDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dequeueSoonOf(t, q, TypeGenerateArtwork); got == nil || got.ID != id {
+		t.Errorf("dequeued %+v after restarting, want %s", got, id)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+/*
+ * Artist square layouts
+ *
+ * A layout only says where each image goes, as cells in a unit square; the
+ * engine in createArtistSquare scales them to the requested size, leaves
+ * ARTIST_SQUARE.GUTTER between them and crops every image to fill its cell.
+ * Every layout takes 1 to maxArtistSquareImages images, in order. Nil images
+ * are placeholders, their cell is filled with ARTIST_SQUARE.PLACEHOLDER_COLOR.
+ */
+
+// maxArtistSquareImages is the most images an artist square can be made of.
+const maxArtistSquareImages = 9
+
+// cell is where one image goes, in fractions of the square's size. A diagonal
+// cell only covers the part of its box where x+y is between s0 and s1.
+type cell struct {
+	x0, y0, x1, y1 float64
+	diagonal       bool
+	s0, s1         float64
+}
+
+// artistSquareLayout returns the cells for n images.
+type artistSquareLayout func(n int) []cell
+
+// artistSquareLayouts are the layouts requests can choose from.
+var artistSquareLayouts = map[string]artistSquareLayout{
+	// Rows of equal tiles, with the first row taking the remainder. For 2, 3
+	// and 4 images these are the layouts artist squares always had.
+	"grid": gridLayout,
+	// Tiles of equal area but different shapes, from halving the square
+	// along its longer side until every image has its own part
+	"mosaic": mosaicLayout,
+	// Bands of equal area along the diagonal, top left to bottom right
+	"diagonal": diagonalLayout,
+	// The first image large, the others in a strip along the bottom
+	"hero": heroLayout,
+}
+
+// layoutNames returns the names of all artistSquareLayouts, sorted.
+func layoutNames() []string {
+	names := make([]string, 0, len(artistSquareLayouts))
+	for name := range artistSquareLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func gridLayout(n int) []cell {
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	rows := (n + cols - 1) / cols
+	cells := make([]cell, 0, n)
+	for row := 0; row < rows; row++ {
+		inRow := cols
+		if row == 0 {
+			inRow = n - cols*(rows-1)
+		}
+		y0, y1 := float64(row)/float64(rows), float64(row+1)/float64(rows)
+		for col := 0; col < inRow; col++ {
+			cells = append(cells, cell{x0: float64(col) / float64(inRow), y0: y0, x1: float64(col+1) / float64(inRow), y1: y1})
+		}
+	}
+	return cells
+}
+
+func mosaicLayout(n int) []cell {
+	var split func(c cell, n int) []cell
+	split = func(c cell, n int) []cell {
+		if n == 1 {
+			return []cell{c}
+		}
+		first, second := c, c
+		share := float64(n/2) / float64(n)
+		if c.x1-c.x0 >= c.y1-c.y0 {
+			first.x1 = c.x0 + (c.x1-c.x0)*share
+			second.x0 = first.x1
+		} else {
+			first.y1 = c.y0 + (c.y1-c.y0)*share
+			second.y0 = first.y1
+		}
+		return append(split(first, n/2), split(second, n-n/2)...)
+	}
+	return split(cell{x1: 1, y1: 1}, n)
+}
+
+func diagonalLayout(n int) []cell {
+	// Where x+y has to be for the area before it to be a, in [0, 1]
+	diagonal := func(a float64) float64 {
+		if a <= 0.5 {
+			return math.Sqrt(2 * a)
+		}
+		return 2 - math.Sqrt(2*(1-a))
+	}
+	cells := make([]cell, 0, n)
+	for i := 0; i < n; i++ {
+		s0, s1 := diagonal(float64(i)/float64(n)), diagonal(float64(i+1)/float64(n))
+		cells = append(cells, cell{
+			x0: math.Max(0, s0-1), y0: math.Max(0, s0-1),
+			x1: math.Min(1, s1), y1: math.Min(1, s1),
+			diagonal: true, s0: s0, s1: s1,
+		})
+	}
+	return cells
+}
+
+func heroLayout(n int) []cell {
+	if n == 1 {
+		return []cell{{x1: 1, y1: 1}}
+	}
+	const strip = 0.25
+	cells := []cell{{x1: 1, y1: 1 - strip}}
+	for i := 0; i < n-1; i++ {
+		cells = append(cells, cell{x0: float64(i) / float64(n-1), y0: 1 - strip, x1: float64(i+1) / float64(n-1), y1: 1})
+	}
+	return cells
+}
+
+// parseHexColor parses a colour written as #rgb or #rrggbb.
+func parseHexColor(s string) (color.RGBA, error) {
+	hex, ok := strings.CutPrefix(s, "#")
+	if ok && len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if !ok || len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("%q is not a #rgb or #rrggbb colour", s)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("%q is not a #rgb or #rrggbb colour", s)
+	}
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xff}, nil
+}
+
+func createArtistSquare(images []image.Image, layoutName string, size int) (image.Image, error) {
+	layout, ok := artistSquareLayouts[layoutName]
+	if !ok {
+		return nil, fmt.Errorf("unknown layout %q", layoutName)
+	}
+	if len(images) < 1 || len(images) > maxArtistSquareImages {
+		return nil, fmt.Errorf("unsupported number of images: %d", len(images))
+	}
+
+	// The gutter is configured for SIZE and scales with the square
+	cfg := currentConfig().ArtistSquare
+	gutter := cfg.Gutter * size / cfg.Size
+	gutterColor, err := parseHexColor(cfg.GutterColor)
+	if err != nil {
+		return nil, err
+	}
+	placeholderColor, err := parseHexColor(cfg.PlaceholderColor)
+	if err != nil {
+		return nil, err
+	}
+	background := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(background, background.Bounds(), image.NewUniform(gutterColor), image.Point{}, draw.Src)
+
+	// edge returns the pixel position of v, moved away from the tile next
+	// to it by its share of the gutter. The square's own edges stay put.
+	edge := func(v float64, start bool) int {
+		px := int(math.Round(v * float64(size)))
+		switch {
+		case v <= 0 || v >= 1:
+			return px
+		case start:
+			return px + gutter/2
+		default:
+			return px - (gutter - gutter/2)
+		}
+	}
+
+	resizeAndDraw := func(img image.Image, rect image.Rectangle, mask image.Image) {
+		if img == nil {
+			// Over, as Src would clear what the mask leaves out of rect
+			draw.DrawMask(background, rect, image.NewUniform(placeholderColor), image.Point{}, mask, rect.Min, draw.Over)
+			return
+		}
+
+		// Calculate aspect ratio
+		srcAspect := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
+		dstAspect := float64(rect.Dx()) / float64(rect.Dy())
+
+		var resizedImg image.Image
+		if srcAspect > dstAspect {
+			// Image is wider, resize based on height
+			newHeight := uint(rect.Dy())
+			newWidth := uint(float64(newHeight) * srcAspect)
+			resizedImg = resize.Resize(newWidth, newHeight, img, resize.Lanczos3)
+		} else {
+			// Image is taller, resize based on width
+			newWidth := uint(rect.Dx())
+			newHeight := uint(float64(newWidth) / srcAspect)
+			resizedImg = resize.Resize(newWidth, newHeight, img, resize.Lanczos3)
+		}
+
+		// Calculate positioning to center the image
+		srcBounds := resizedImg.Bounds()
+		dx := (srcBounds.Dx() - rect.Dx()) / 2
+		dy := (srcBounds.Dy() - rect.Dy()) / 2
+		if mask == nil {
+			draw.Draw(background, rect, resizedImg, image.Point{dx, dy}, draw.Src)
+		} else {
+			draw.DrawMask(background, rect, resizedImg, image.Point{dx, dy}, mask, rect.Min, draw.Over)
+		}
+	}
+
+	for i, c := range layout(len(images)) {
+		var rect image.Rectangle
+		var mask image.Image
+		if c.diagonal {
+			// The mask leaves the gutter, the box is only there to crop
+			// the image to
+			rect = image.Rect(int(c.x0*float64(size)), int(c.y0*float64(size)),
+				int(math.Ceil(c.x1*float64(size))), int(math.Ceil(c.y1*float64(size))))
+			mask = diagonalMask(rect, size, gutter, c.s0, c.s1)
+		} else {
+			rect = image.Rect(edge(c.x0, true), edge(c.y0, true), edge(c.x1, false), edge(c.y1, false))
+		}
+		if rect.Empty() {
+			continue
+		}
+		resizeAndDraw(images[i], rect, mask)
+	}
+
+	return background, nil
+}
+
+// diagonalMask returns a mask over rect that is opaque where pixel centres
+// are between s0 and s1 along the diagonal of a square size pixels wide,
+// less half the gutter on each side that borders another band.
+func diagonalMask(rect image.Rectangle, size, gutter int, s0, s1 float64) *image.Alpha {
+	// The gutter is measured across the bands, x+y grows by √2 per pixel
+	// in that direction
+	inset := float64(gutter) / 2 * math.Sqrt2
+	lo, hi := s0*float64(size), s1*float64(size)
+	if s0 > 0 {
+		lo += inset
+	}
+	if s1 < 2 {
+		hi -= inset
+	} else {
+		hi = math.Inf(1)
+	}
+
+	mask := image.NewAlpha(rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if s := float64(x+y) + 1; s >= lo && s < hi {
+				mask.SetAlpha(x, y, color.Alpha{A: 0xff})
+			}
+		}
+	}
+	return mask
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden artist squares in testdata")
+
+// goldenSize is the size golden artist squares are made at, small enough to
+// keep testdata small but large enough to show every tile.
+const goldenSize = 96
+
+// testImages returns n distinct images of different aspect ratios, striped
+// so that how each is cropped shows.
+func testImages(n int) []image.Image {
+	palette := []color.RGBA{
+		{0xe6, 0x19, 0x4b, 0xff}, {0x3c, 0xb4, 0x4b, 0xff}, {0xff, 0xe1, 0x19, 0xff},
+		{0x43, 0x63, 0xd8, 0xff}, {0xf5, 0x82, 0x31, 0xff}, {0x91, 0x1e, 0xb4, 0xff},
+		{0x46, 0xf0, 0xf0, 0xff}, {0xf0, 0x32, 0xe6, 0xff}, {0xbc, 0xf6, 0x0c, 0xff},
+	}
+	sizes := []image.Point{{60, 60}, {90, 40}, {40, 90}}
+	images := make([]image.Image, n)
+	for i := range images {
+		size := sizes[i%len(sizes)]
+		img := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				c := palette[i]
+				if (x/10+y/10)%2 == 1 {
+					c = color.RGBA{c.R / 2, c.G / 2, c.B / 2, 0xff}
+				}
+				img.SetRGBA(x, y, c)
+			}
+		}
+		images[i] = img
+	}
+	return images
+}
+
+// setupArtistSquareTest makes goldenSize the configured size, with gutter
+// pixels between tiles.
+func setupArtistSquareTest(t *testing.T, gutter int) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.ArtistSquare.Size = goldenSize
+	cfg.ArtistSquare.Gutter = gutter
+	cfg.ArtistSquare.GutterColor = "#ffffff"
+	cfg.ArtistSquare.PlaceholderColor = "#808080"
+	liveConfig.Store(cfg)
+}
+
+func TestArtistSquareGolden(t *testing.T) {
+	for _, variant := range []struct {
+		name   string
+		gutter int
+		// placeholders replaces every other image with a placeholder
+		placeholders bool
+	}{
+		{name: "plain"},
+		{name: "gutter", gutter: 6},
+		{name: "placeholders", gutter: 6, placeholders: true},
+	} {
+		for _, layout := range layoutNames() {
+			for n := 1; n <= maxArtistSquareImages; n++ {
+				name := fmt.Sprintf("%s_%s_%d", layout, variant.name, n)
+				t.Run(name, func(t *testing.T) {
+					setupArtistSquareTest(t, variant.gutter)
+					images := testImages(n)
+					if variant.placeholders {
+						for i := 1; i < n; i += 2 {
+							images[i] = nil
+						}
+					}
+					square, err := createArtistSquare(images, layout, goldenSize)
+					if err != nil {
+						t.Fatal(err)
+					}
+					compareGolden(t, filepath.Join("testdata", "squares", name+".png"), square)
+				})
+			}
+		}
+	}
+}
+
+// compareGolden compares img with the PNG at path, or rewrites the PNG with
+// -update. Channels may be off by a little, floating point rounding in the
+// resampler differs between architectures.
+func compareGolden(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	if *updateGolden {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("%v, run the test with -update to create it", err)
+	}
+	defer file.Close()
+	golden, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if golden.Bounds() != img.Bounds() {
+		t.Fatalf("square is %v, golden image is %v", img.Bounds(), golden.Bounds())
+	}
+	const tolerance = 2
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			if !similar(img.At(x, y), golden.At(x, y), tolerance) {
+				t.Fatalf("pixel (%d, %d) is %v, golden image has %v", x, y, img.At(x, y), golden.At(x, y))
+			}
+		}
+	}
+}
+
+func similar(a, b color.Color, tolerance int) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8), int(a1>>8) - int(a2>>8)} {
+		if d < -tolerance || d > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// TestGridMatchesBaseline makes sure the grid layout puts 2, 3 and 4 images
+// exactly where artist squares always had them.
+func TestGridMatchesBaseline(t *testing.T) {
+	const size = 500
+	baseline := map[int][]image.Rectangle{
+		2: {
+			image.Rect(0, 0, size/2, size),
+			image.Rect(size/2, 0, size, size),
+		},
+		3: {
+			image.Rect(0, 0, size, size/2),
+			image.Rect(0, size/2, size/2, size),
+			image.Rect(size/2, size/2, size, size),
+		},
+		4: {
+			image.Rect(0, 0, size/2, size/2),
+			image.Rect(size/2, 0, size, size/2),
+			image.Rect(0, size/2, size/2, size),
+			image.Rect(size/2, size/2, size, size),
+		},
+	}
+	liveConfig.Store(defaultConfig())
+
+	for n, rects := range baseline {
+		cells := gridLayout(n)
+		if len(cells) != len(rects) {
+			t.Fatalf("%d images: %d cells, want %d", n, len(cells), len(rects))
+		}
+		for i, c := range cells {
+			px := func(v float64) int { return int(math.Round(v * size)) }
+			got := image.Rect(px(c.x0), px(c.y0), px(c.x1), px(c.y1))
+			if got != rects[i] {
+				t.Errorf("%d images: image %d goes to %v, want %v", n, i, got, rects[i])
+			}
+		}
+
+		// And the rendered square is the baseline's: solid images come out
+		// as their colour, filling exactly their rectangle
+		images := make([]image.Image, n)
+		want := image.NewRGBA(image.Rect(0, 0, size, size))
+		for i := range images {
+			c := &image.Uniform{C: color.RGBA{uint8(40 * (i + 1)), uint8(255 - 40*i), 0x80, 0xff}}
+			solid := image.NewRGBA(image.Rect(0, 0, 300, 200))
+			draw.Draw(solid, solid.Bounds(), c, image.Point{}, draw.Src)
+			images[i] = solid
+			draw.Draw(want, rects[i], c, image.Point{}, draw.Src)
+		}
+		square, err := createArtistSquare(images, "grid", size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				if !similar(square.At(x, y), want.At(x, y), 0) {
+					t.Fatalf("%d images: pixel (%d, %d) is %v, want %v", n, x, y, square.At(x, y), want.At(x, y))
+				}
+			}
+		}
+	}
+}
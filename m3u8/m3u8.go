@@ -0,0 +1,225 @@
+// Package m3u8 parses the HLS master playlists animated artwork is served as
+// (RFC 8216, section 4.3.4). Only what's needed to pick a variant is kept,
+// unknown tags and attributes are ignored.
+package m3u8
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrNotMasterPlaylist is returned when a playlist parses, but is a media
+// playlist rather than a master playlist.
+var ErrNotMasterPlaylist = errors.New("not a master playlist")
+
+// MasterPlaylist is a parsed HLS master playlist. All URIs in it are absolute.
+type MasterPlaylist struct {
+	Variants []Variant
+	// IFrameVariants are the EXT-X-I-FRAME-STREAM-INF variants, they only
+	// contain key frames and are meant for trick play.
+	IFrameVariants []Variant
+	Media          []Media
+}
+
+// Variant is a single EXT-X-STREAM-INF or EXT-X-I-FRAME-STREAM-INF entry.
+type Variant struct {
+	URI              string
+	Bandwidth        int
+	AverageBandwidth int
+	Codecs           []string
+	Width            int
+	Height           int
+	FrameRate        float64
+	// VideoRange is SDR, HLG or PQ, empty if the playlist doesn't say
+	VideoRange string
+	HDCPLevel  string
+	// Rendition groups, matched against Media.GroupID
+	Audio     string
+	Video     string
+	Subtitles string
+	IFrame    bool
+}
+
+// HasCodec reports whether the variant uses a codec with the given sample
+// entry, such as "avc1" or "hvc1".
+func (v Variant) HasCodec(format string) bool {
+	for _, codec := range v.Codecs {
+		if codec == format || strings.HasPrefix(codec, format+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Media is an EXT-X-MEDIA rendition.
+type Media struct {
+	Type       string
+	GroupID    string
+	Name       string
+	Language   string
+	URI        string
+	Default    bool
+	Autoselect bool
+	Channels   string
+}
+
+// ParseMaster parses a master playlist read from r, resolving relative URIs
+// against base.
+func ParseMaster(r io.Reader, base *url.URL) (*MasterPlaylist, error) {
+	resolve := func(uri string) (string, error) {
+		ref, err := url.Parse(uri)
+		if err != nil {
+			return "", fmt.Errorf("invalid URI %q: %w", uri, err)
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+
+	playlist := &MasterPlaylist{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	// An EXT-X-STREAM-INF tag applies to the URI on the next non-tag line
+	var pending *Variant
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		if lineNo == 1 {
+			if line != "#EXTM3U" {
+				return nil, fmt.Errorf("missing #EXTM3U header")
+			}
+			continue
+		}
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			v := parseVariant(parseAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:")))
+			pending = &v
+		case strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:"):
+			attrs := parseAttributes(strings.TrimPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:"))
+			v := parseVariant(attrs)
+			v.IFrame = true
+			if attrs["URI"] == "" {
+				return nil, fmt.Errorf("line %d: EXT-X-I-FRAME-STREAM-INF without URI", lineNo)
+			}
+			uri, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			v.URI = uri
+			playlist.IFrameVariants = append(playlist.IFrameVariants, v)
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			attrs := parseAttributes(strings.TrimPrefix(line, "#EXT-X-MEDIA:"))
+			media := Media{
+				Type:       attrs["TYPE"],
+				GroupID:    attrs["GROUP-ID"],
+				Name:       attrs["NAME"],
+				Language:   attrs["LANGUAGE"],
+				Default:    attrs["DEFAULT"] == "YES",
+				Autoselect: attrs["AUTOSELECT"] == "YES",
+				Channels:   attrs["CHANNELS"],
+			}
+			if attrs["URI"] != "" {
+				uri, err := resolve(attrs["URI"])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNo, err)
+				}
+				media.URI = uri
+			}
+			playlist.Media = append(playlist.Media, media)
+		case strings.HasPrefix(line, "#EXTINF:"), strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			return nil, ErrNotMasterPlaylist
+		case strings.HasPrefix(line, "#"):
+			// Comments and tags we don't use
+		default:
+			if pending == nil {
+				return nil, fmt.Errorf("line %d: URI without EXT-X-STREAM-INF", lineNo)
+			}
+			uri, err := resolve(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			pending.URI = uri
+			playlist.Variants = append(playlist.Variants, *pending)
+			pending = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lineNo == 0 {
+		return nil, fmt.Errorf("empty playlist")
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("EXT-X-STREAM-INF without URI at end of playlist")
+	}
+
+	return playlist, nil
+}
+
+func parseVariant(attrs map[string]string) Variant {
+	v := Variant{
+		VideoRange: attrs["VIDEO-RANGE"],
+		HDCPLevel:  attrs["HDCP-LEVEL"],
+		Audio:      attrs["AUDIO"],
+		Video:      attrs["VIDEO"],
+		Subtitles:  attrs["SUBTITLES"],
+	}
+	v.Bandwidth, _ = strconv.Atoi(attrs["BANDWIDTH"])
+	v.AverageBandwidth, _ = strconv.Atoi(attrs["AVERAGE-BANDWIDTH"])
+	v.FrameRate, _ = strconv.ParseFloat(attrs["FRAME-RATE"], 64)
+	if codecs := attrs["CODECS"]; codecs != "" {
+		for _, codec := range strings.Split(codecs, ",") {
+			v.Codecs = append(v.Codecs, strings.TrimSpace(codec))
+		}
+	}
+	if width, height, ok := strings.Cut(attrs["RESOLUTION"], "x"); ok {
+		v.Width, _ = strconv.Atoi(width)
+		v.Height, _ = strconv.Atoi(height)
+	}
+	return v
+}
+
+// parseAttributes parses an attribute list such as
+// BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2". Quoted values may contain
+// commas and have their quotes removed.
+func parseAttributes(list string) map[string]string {
+	attrs := make(map[string]string)
+	for list != "" {
+		name, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			break
+		}
+		name = strings.TrimSpace(name)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				// Unterminated, take the rest of the line
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			// Skip to the next attribute
+			if i := strings.IndexByte(rest, ','); i >= 0 {
+				rest = rest[i+1:]
+			} else {
+				rest = ""
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+
+		attrs[name] = value
+		list = rest
+	}
+	return attrs
+}
@@ -0,0 +1,141 @@
+package m3u8
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testBase = "https://mvod.itunes.apple.com/itunes-assets/HLSMusic/v4/ab/cd/master.m3u8"
+
+func TestParseMaster(t *testing.T) {
+	const dir = "https://mvod.itunes.apple.com/itunes-assets/HLSMusic/v4/ab/cd/"
+	for _, tt := range []struct {
+		file string
+		want *MasterPlaylist
+	}{
+		{
+			file: "square.m3u8",
+			want: &MasterPlaylist{
+				Variants: []Variant{
+					{URI: dir + "P1001_A1496488361_video_gr290_sdr_540x540-.m3u8", Bandwidth: 1183654, AverageBandwidth: 886032, Codecs: []string{"avc1.64001f"}, Width: 540, Height: 540, FrameRate: 29.97, VideoRange: "SDR"},
+					{URI: dir + "P1001_A1496488361_video_gr290_sdr_1080x1080-.m3u8", Bandwidth: 4219577, AverageBandwidth: 3105541, Codecs: []string{"avc1.640028"}, Width: 1080, Height: 1080, FrameRate: 29.97, VideoRange: "SDR"},
+					{URI: dir + "P1001_A1496488361_video_gr290_hdr_1080x1080-.m3u8", Bandwidth: 2312087, AverageBandwidth: 1730112, Codecs: []string{"hvc1.2.4.L123.B0"}, Width: 1080, Height: 1080, FrameRate: 29.97, VideoRange: "PQ", HDCPLevel: "NONE"},
+					{URI: dir + "P1001_A1496488361_video_gr290_dovi_1080x1080-.m3u8", Bandwidth: 2540331, AverageBandwidth: 1901644, Codecs: []string{"dvh1.08.06"}, Width: 1080, Height: 1080, FrameRate: 29.97, VideoRange: "PQ"},
+				},
+				IFrameVariants: []Variant{
+					{URI: dir + "P1001_A1496488361_video_gr290_sdr_540x540-iframe.m3u8", Bandwidth: 121467, Codecs: []string{"avc1.64001f"}, Width: 540, Height: 540, VideoRange: "SDR", IFrame: true},
+					{URI: dir + "P1001_A1496488361_video_gr290_sdr_1080x1080-iframe.m3u8", Bandwidth: 402554, Codecs: []string{"avc1.640028"}, Width: 1080, Height: 1080, VideoRange: "SDR", IFrame: true},
+				},
+			},
+		},
+		{
+			file: "tall_with_audio.m3u8",
+			want: &MasterPlaylist{
+				Variants: []Variant{
+					{URI: dir + "video/720x1280.m3u8", Bandwidth: 2075131, AverageBandwidth: 1522407, Codecs: []string{"avc1.64001f", "mp4a.40.2"}, Width: 720, Height: 1280, FrameRate: 23.976, VideoRange: "SDR", Audio: "audio-stereo-160"},
+					{URI: "https://mvod.itunes.apple.com/itunes-assets/HLSMusic/video/1080x1920.m3u8", Bandwidth: 5964251, Codecs: []string{"hvc1.2.4.L123.B0", "mp4a.40.2"}, Width: 1080, Height: 1920, FrameRate: 23.976, VideoRange: "HLG", Audio: "audio-stereo-160"},
+				},
+				Media: []Media{
+					{Type: "AUDIO", GroupID: "audio-stereo-160", Name: "English", Language: "en", URI: "https://mvod.itunes.apple.com/itunes-assets/HLSMusic/v4/ab/audio/stereo_160.m3u8", Default: true, Autoselect: true, Channels: "2"},
+					{Type: "AUDIO", GroupID: "audio-stereo-160", Name: "Commentary", URI: "https://mvod.itunes.apple.com/itunes-assets/HLSMusic/audio/commentary.m3u8?token=a,b", Channels: "2"},
+				},
+			},
+		},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := parseFixture(t, tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMasterErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		playlist string
+		// want is matched with errors.Is if set, else wantText against the message
+		want     error
+		wantText string
+	}{
+		{name: "media playlist", playlist: "testdata/media.m3u8", want: ErrNotMasterPlaylist},
+		{name: "empty", playlist: "", wantText: "empty playlist"},
+		{name: "missing header", playlist: "#EXT-X-VERSION:7\n", wantText: "missing #EXTM3U"},
+		{name: "URI without stream", playlist: "#EXTM3U\nvideo.m3u8\n", wantText: "line 2: URI without EXT-X-STREAM-INF"},
+		{name: "stream without URI", playlist: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n", wantText: "EXT-X-STREAM-INF without URI"},
+		{name: "I-frame stream without URI", playlist: "#EXTM3U\n#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=1\n", wantText: "line 2: EXT-X-I-FRAME-STREAM-INF without URI"},
+		{name: "invalid URI", playlist: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nhttp://[::1\n", wantText: "line 3: invalid URI"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if file, ok := strings.CutPrefix(tt.playlist, "testdata/"); ok {
+				_, err = parseFixture(t, file)
+			} else {
+				_, err = ParseMaster(strings.NewReader(tt.playlist), mustParse(t, testBase))
+			}
+			switch {
+			case err == nil:
+				t.Fatal("parsed without error")
+			case tt.want != nil && !errors.Is(err, tt.want):
+				t.Errorf("error = %v, want %v", err, tt.want)
+			case tt.want == nil && !strings.Contains(err.Error(), tt.wantText):
+				t.Errorf("error = %v, want one containing %q", err, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	for _, tt := range []struct {
+		list string
+		want map[string]string
+	}{
+		{`BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"`, map[string]string{"BANDWIDTH": "1280000", "CODECS": "avc1.4d401f,mp4a.40.2"}},
+		{`URI="a,b.m3u8", NAME="x"`, map[string]string{"URI": "a,b.m3u8", "NAME": "x"}},
+		{`CODECS="",RESOLUTION=540x540`, map[string]string{"CODECS": "", "RESOLUTION": "540x540"}},
+		{`NAME="unterminated`, map[string]string{"NAME": "unterminated"}},
+		{`BANDWIDTH=1,garbage`, map[string]string{"BANDWIDTH": "1"}},
+		{``, map[string]string{}},
+	} {
+		if got := parseAttributes(tt.list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAttributes(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestHasCodec(t *testing.T) {
+	v := Variant{Codecs: []string{"hvc1.2.4.L123.B0", "mp4a.40.2"}}
+	for codec, want := range map[string]bool{"hvc1": true, "mp4a": true, "avc1": false, "hvc": false} {
+		if got := v.HasCodec(codec); got != want {
+			t.Errorf("HasCodec(%q) = %v, want %v", codec, got, want)
+		}
+	}
+}
+
+func parseFixture(t *testing.T, name string) (*MasterPlaylist, error) {
+	t.Helper()
+	file, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	return ParseMaster(file, mustParse(t, testBase))
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
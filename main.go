@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -18,6 +24,7 @@ var (
 	artistSquares string
 	icloudArt     string
 	animatedArt   string
+	sources       string
 )
 
 func init() {
@@ -37,33 +44,35 @@ func init() {
 		},
 	})
 
-	// Get the directory of the executable
-	ex, err := os.Executable()
-	if err != nil {
-		logger.Fatalf("Error getting executable path: %v", err)
-	}
-	exPath := filepath.Dir(ex)
+	ffmpeg.LogCompiledCommand = false
+}
 
+func setupDirectories(root string) error {
 	// Set up directories with absolute paths
-	cacheDir = filepath.Join(exPath, "cache")
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return fmt.Errorf("invalid cache directory %s: %w", root, err)
+	}
+	cacheDir = root
 	artistSquares = filepath.Join(cacheDir, "artist-squares")
 	icloudArt = filepath.Join(cacheDir, "icloud-art")
 	animatedArt = filepath.Join(cacheDir, "animated-art")
+	sources = filepath.Join(cacheDir, "sources")
 
-	logger.Info("AniArt priming up...")
-	logger.Infof("Published URI: %s", getBaseURI())
 	logger.Infof("Cache directory: %s", cacheDir)
 	logger.Infof("Artist Squares directory: %s", artistSquares)
 	logger.Infof("iCloud Art directory: %s", icloudArt)
 	logger.Infof("Animated Art directory: %s", animatedArt)
-
-	ffmpeg.LogCompiledCommand = false
+	logger.Infof("Source cache directory: %s", sources)
 
 	ensureDirectories()
+	sweepTempFiles()
+	pruneSourceCache()
+	return nil
 }
 
 func ensureDirectories() {
-	dirs := []string{cacheDir, artistSquares, icloudArt, animatedArt}
+	dirs := []string{cacheDir, artistSquares, icloudArt, animatedArt, sources}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 			logger.Errorf("Error creating directory %s: %v", dir, err)
@@ -71,84 +80,219 @@ func ensureDirectories() {
 	}
 }
 
+// sweepTempFiles removes temporary outputs left behind by generations that
+// were interrupted, e.g. by the process being killed.
+func sweepTempFiles() {
+	var matches []string
+	for _, dir := range []string{animatedArt, artistSquares, sources} {
+		found, err := filepath.Glob(filepath.Join(dir, "*_temp.*"))
+		if err != nil {
+			logger.Errorf("Error listing temporary files: %v", err)
+			return
+		}
+		matches = append(matches, found...)
+	}
+	for _, path := range matches {
+		logger.Infof("Removing stale temporary file %s", path)
+		if err := os.Remove(path); err != nil {
+			logger.Errorf("Failed to remove temporary file %s: %v", path, err)
+		}
+	}
+}
+
 func main() {
+	config, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	liveConfig.Store(config)
+
+	// Connections to source hosts are pooled for every job, the pool can't
+	// be resized once it's in use
+	sourceTransport.MaxConnsPerHost = config.Fetch.MaxConnsPerHost
+	sourceTransport.MaxIdleConnsPerHost = config.Fetch.MaxConnsPerHost
+
+	logger.Info("AniArt priming up...")
+	logger.Infof("Published URI: %s", config.PublishedURI)
+	if err := setupDirectories(config.CacheDir); err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	queue, err := openJobQueue(config.Queue)
+	if err != nil {
+		logger.Fatalf("Failed to open %s job queue: %v", config.Queue.Backend, err)
+	}
+	defer queue.Close()
+	logger.Infof("Job queue backend: %s", config.Queue.Backend)
+
+	jobs = newJobManager(queue, config.Queue.Workers)
+	registerJobHandlers(jobs)
+	jobs.start()
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go watchConfig(watchCtx, os.Args[1:])
+
 	gin.SetMode(gin.ReleaseMode)
 	gin.ForceConsoleColor()
 	r := gin.Default()
 
 	// Routes
-	r.GET("/artwork/generate", generateArtwork)
+	r.GET("/artwork/generate", generateAnimatedArtwork("gif"))
+	r.GET("/artwork/generate_alt", generateAnimatedArtwork("webp", "avif", "apng"))
+	r.GET("/artwork/generate_video", generateAnimatedArtwork("mp4", "hevc"))
 	r.GET("/artwork/:key", getArtwork)
 	r.POST("/artwork/artist-square", generateArtistSquare)
 	r.GET("/artwork/artist-square/:key", getArtistSquare)
 	r.POST("/artwork/icloud", generateICloudArt)
 	r.GET("/artwork/icloud/:key", getICloudArt)
-
-	// Experimental, WEBP support.
-	r.GET("/artwork/generate_alt", generateAltArtwork)
+	r.GET("/jobs/:id", getJob)
+	r.GET("/metrics", getMetrics)
 
 	// Start server
-	if err := r.Run(":3000"); err != nil {
-		logger.Fatal("Failed to start server: ", err)
+	srv := &http.Server{
+		Addr:    config.ListenAddr,
+		Handler: r,
 	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("Failed to start server: ", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	// Restore default signal handling so a second signal kills immediately
+	stop()
+
+	shutdownTimeout := currentConfig().ShutdownTimeout
+	logger.Infof("Shutting down, waiting up to %s for running jobs...", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting requests first, requests already waiting on a job are
+	// allowed to finish, then drain the workers.
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Error shutting down server: %v", err)
+	}
+	if err := jobs.shutdown(shutdownCtx); err != nil {
+		logger.Warnf("Unfinished jobs were left queued for the next start")
+	}
+
+	logger.Info("AniArt stopped")
 }
 
 func getArtwork(c *gin.Context) {
-	key := strings.TrimSuffix(strings.TrimSuffix(c.Param("key"), ".gif"), ".webp")
-	gifPath := filepath.Join(animatedArt, fmt.Sprintf("%s.gif", key))
-	webpPath := filepath.Join(animatedArt, fmt.Sprintf("%s.webp", key))
+	// Responses depend on Accept, caches must not hand one client's
+	// rendition to another
+	c.Header("Vary", "Accept")
 
-	if _, err := os.Stat(gifPath); os.IsNotExist(err) {
-		if _, err := os.Stat(webpPath); os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Artwork not found"})
+	key, requested := c.Param("key"), ""
+	for _, f := range servedFormats {
+		if strings.HasSuffix(key, "."+f.ext) {
+			key, requested = strings.TrimSuffix(key, "."+f.ext), f.ext
+			break
+		}
+	}
+
+	var available []*outputFormat
+	// Renditions generated from another one are stored under their own key
+	keys := make(map[*outputFormat]string)
+	for _, f := range servedFormats {
+		fkey, err := renditionKey(key, f)
+		if err != nil {
+			logger.Errorf("Error accessing %s for key %s: %v", f.label, key, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error accessing %s", f.label)})
 			return
-		} else if err != nil {
-			logger.Errorf("Error accessing WEBP for key %s: %v", key, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error accessing WEBP"})
+		} else if fkey == "" {
+			continue
+		}
+		// An explicit extension is served as is, regardless of Accept
+		if f.ext == requested {
+			serveAnimatedFile(c, fkey, f)
 			return
 		}
-		c.File(webpPath)
+		available = append(available, f)
+		keys[f] = fkey
+	}
+
+	if len(available) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Artwork not found"})
 		return
-	} else if err != nil {
-		logger.Errorf("Error accessing GIF for key %s: %v", key, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error accessing GIF"})
+	}
+
+	// If the client explicitly prefers a format that doesn't exist yet,
+	// generate it for next time
+	var jobID string
+	if currentConfig().Animated.GenerateMissing && requested == "" {
+		if best := negotiateArtwork(servedFormats, c.GetHeader("Accept")); len(best) > 0 && best[0].exact && !slices.Contains(available, best[0].outputFormat) {
+			var err error
+			if jobID, err = generateRendition(key, best[0].name); err != nil {
+				logger.Warnf("Failed to generate %s for key %s: %v", best[0].name, key, err)
+			}
+		}
+	}
+
+	acceptable := negotiateArtwork(available, c.GetHeader("Accept"))
+	if len(acceptable) == 0 {
+		if jobID != "" {
+			c.JSON(http.StatusAccepted, gin.H{
+				"key":     key,
+				"job_id":  jobID,
+				"message": "Artwork is being generated in an acceptable format. Please check back later.",
+				"status":  fmt.Sprintf("%s/jobs/%s", currentConfig().PublishedURI, jobID),
+			})
+			return
+		}
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": "Artwork is not available in an acceptable format"})
 		return
 	}
 
-	c.File(gifPath)
+	serveAnimatedFile(c, keys[acceptable[0].outputFormat], acceptable[0].outputFormat)
+}
+
+// serveAnimatedFile serves the artwork with key in format f. The content type
+// is set explicitly since not every system's MIME table knows them all.
+func serveAnimatedFile(c *gin.Context, key string, f *outputFormat) {
+	c.Header("Content-Type", f.contentType)
+	c.File(f.path(key))
 }
 
 func getArtistSquare(c *gin.Context) {
-	key := strings.TrimSuffix(c.Param("key"), ".jpg")
-	squarePath := filepath.Join(artistSquares, fmt.Sprintf("%s.jpg", key))
+	// Without an extension, whichever format the square was generated in
+	key, formats := c.Param("key"), squareFormats
+	for _, f := range squareFormats {
+		if strings.HasSuffix(key, "."+f.ext) {
+			key, formats = strings.TrimSuffix(key, "."+f.ext), []*squareFormat{f}
+			break
+		}
+	}
 
-	if _, err := os.Stat(squarePath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Artist Square not found"})
-		return
-	} else if err != nil {
-		logger.Errorf("Error accessing Artist Square for key %s: %v", key, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error accessing Artist Square"})
+	for _, f := range formats {
+		if _, err := os.Stat(f.path(key)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			logger.Errorf("Error accessing Artist Square for key %s: %v", key, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error accessing Artist Square"})
+			return
+		}
+		c.Header("Content-Type", f.contentType)
+		c.File(f.path(key))
 		return
 	}
 
-	c.File(squarePath)
+	c.JSON(http.StatusNotFound, gin.H{"error": "Artist Square not found"})
 }
 
 func getICloudArt(c *gin.Context) {
 	key := c.Param("key")
 
-	// Check for each possible format
-	formats := []string{"jpg", "jpeg", "png", "gif"}
-	var iCloudPath string
-
-	for _, format := range formats {
-		testPath := filepath.Join(icloudArt, fmt.Sprintf("%s.%s", key, format))
-		if _, err := os.Stat(testPath); err == nil {
-			iCloudPath = testPath
-			break
-		}
-	}
+	// Published URLs include the extension, older clients may omit it
+	key = strings.TrimSuffix(key, filepath.Ext(key))
 
+	iCloudPath := findICloudArt(key)
 	if iCloudPath == "" {
 		c.JSON(http.StatusNotFound, gin.H{"error": "iCloud Art not found"})
 		return
@@ -156,3 +300,17 @@ func getICloudArt(c *gin.Context) {
 
 	c.File(iCloudPath)
 }
+
+func getJob(c *gin.Context) {
+	job, err := jobs.queue.Get(c.Param("id"))
+	if errors.Is(err, ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	} else if err != nil {
+		logger.Errorf("Error accessing job %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error accessing job"})
+		return
+	}
+
+	c.JSON(http.StatusOK, job.status())
+}
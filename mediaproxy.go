@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Media playlist proxy
+ *
+ * ffmpeg can't be trusted with source URLs: it resolves hosts and follows
+ * redirects by itself. Instead it is handed a copy of the variant's media
+ * playlist served from the loopback interface, in which every URI (segments,
+ * EXT-X-MAP, EXT-X-KEY) points back at the proxy. The proxy fetches them
+ * through the outbound client, so every hop is checked against the URL policy
+ * and the network rules just like any other fetch.
+ */
+
+// maxPlaylistBytes bounds the playlists read into memory.
+const maxPlaylistBytes = 1 << 20
+
+// ErrPlaylistTooLarge is returned for playlists over maxPlaylistBytes, which
+// would otherwise be cut short.
+var ErrPlaylistTooLarge = fmt.Errorf("playlist is larger than %d bytes", maxPlaylistBytes)
+
+// ErrNotMediaPlaylist is returned for playlists ffmpeg would have to fetch
+// further playlists for, which the proxy can't rewrite in advance.
+var ErrNotMediaPlaylist = errors.New("not a media playlist")
+
+// playlistURIAttribute matches the URI attribute of tags like EXT-X-MAP.
+var playlistURIAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// mediaProxy serves one media playlist and the files it references.
+type mediaProxy struct {
+	client *http.Client
+	// prefix is random, so the proxy only serves the URLs it handed out
+	prefix   string
+	playlist []byte
+	// targets are the upstream URLs, by the index in their proxy path
+	targets  []*url.URL
+	listener net.Listener
+	server   *http.Server
+}
+
+// startMediaProxy fetches the media playlist at playlistURL with client and
+// starts serving it on the loopback interface until ctx is done or Close is
+// called. Every URI in the playlist must be allowed by policy and resolve to
+// an address dialer allows.
+func startMediaProxy(ctx context.Context, client *http.Client, policy URLPolicy, dialer *outboundDialer, playlistURL string) (*mediaProxy, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, playlistURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch media playlist: %w", err)
+	}
+	req.Header.Set("User-Agent", "AniArt/1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch media playlist: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch media playlist: %s", resp.Status)
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	p := &mediaProxy{client: client, prefix: "/" + hex.EncodeToString(token) + "/"}
+
+	// Relative URIs resolve against wherever redirects ended up. The hosts
+	// are resolved up front too, for a clearer error than ffmpeg's.
+	playlist, err := readPlaylist(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch media playlist: %w", err)
+	}
+	if err := p.rewrite(ctx, bytes.NewReader(playlist), resp.Request.URL, policy, dialer); err != nil {
+		return nil, err
+	}
+
+	if p.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, fmt.Errorf("failed to start media proxy: %w", err)
+	}
+	p.server = &http.Server{
+		Handler:     p,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go p.server.Serve(p.listener)
+	context.AfterFunc(ctx, func() { p.Close() })
+	return p, nil
+}
+
+// readPlaylist reads a whole playlist from r, failing rather than cutting it
+// short past maxPlaylistBytes.
+func readPlaylist(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxPlaylistBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPlaylistBytes {
+		return nil, ErrPlaylistTooLarge
+	}
+	return data, nil
+}
+
+// URL returns where ffmpeg fetches the playlist.
+func (p *mediaProxy) URL() string {
+	return "http://" + p.listener.Addr().String() + p.prefix + "playlist.m3u8"
+}
+
+func (p *mediaProxy) Close() error {
+	return p.server.Close()
+}
+
+// rewrite reads the playlist from r and stores a copy with every URI
+// replaced by one pointing at the proxy.
+func (p *mediaProxy) rewrite(ctx context.Context, r io.Reader, base *url.URL, policy URLPolicy, dialer *outboundDialer) error {
+	checkedHosts := make(map[string]bool)
+	proxied := func(uri string) (string, error) {
+		ref, err := url.Parse(uri)
+		if err != nil {
+			return "", fmt.Errorf("invalid URI %q in media playlist", uri)
+		}
+		u := base.ResolveReference(ref)
+		if err := policy.Check(u); err != nil {
+			return "", err
+		}
+		if !checkedHosts[u.Hostname()] {
+			if _, err := dialer.resolve(ctx, u.Hostname()); err != nil {
+				return "", err
+			}
+			checkedHosts[u.Hostname()] = true
+		}
+
+		// ffmpeg may go by the extension, keep the file name
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			name = "index"
+		}
+		p.targets = append(p.targets, u)
+		return fmt.Sprintf("%s%d/%s", p.prefix, len(p.targets)-1, url.PathEscape(name)), nil
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			if line != "#EXTM3U" {
+				return fmt.Errorf("invalid media playlist: missing #EXTM3U")
+			}
+			first = false
+		}
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"), strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF"), strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			return ErrNotMediaPlaylist
+		case strings.HasPrefix(line, "#"):
+			// Tags such as EXT-X-MAP and EXT-X-KEY carry URIs in an attribute
+			var failed error
+			line = playlistURIAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				rewritten, err := proxied(playlistURIAttribute.FindStringSubmatch(attr)[1])
+				if err != nil {
+					failed = errors.Join(failed, err)
+					return attr
+				}
+				return `URI="` + rewritten + `"`
+			})
+			if failed != nil {
+				return failed
+			}
+		default:
+			var err error
+			if line, err = proxied(line); err != nil {
+				return err
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read media playlist: %w", err)
+	}
+	if first {
+		return fmt.Errorf("invalid media playlist: empty")
+	}
+	p.playlist = out.Bytes()
+	return nil
+}
+
+func (p *mediaProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, p.prefix)
+	if !ok || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	if rest == "playlist.m3u8" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write(p.playlist)
+		return
+	}
+	index, _, _ := strings.Cut(rest, "/")
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= len(p.targets) {
+		http.NotFound(w, r)
+		return
+	}
+	target := p.targets[i]
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	req.Header.Set("User-Agent", "AniArt/1.0")
+	// ffmpeg asks for byte ranges of segments with EXT-X-BYTERANGE
+	if rng := r.Header.Get("Range"); rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		logger.Warnf("Media proxy failed to fetch %s: %v", target.Redacted(), err)
+		http.Error(w, "failed to fetch", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	// A playlist here would have ffmpeg fetch whatever it points at itself
+	body := bufio.NewReader(resp.Body)
+	if head, _ := body.Peek(len("#EXTM3U")); string(head) == "#EXTM3U" {
+		logger.Warnf("Media proxy refused nested playlist %s", target.Redacted())
+		http.Error(w, ErrNotMediaPlaylist.Error(), http.StatusBadGateway)
+		return
+	}
+
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, body)
+}
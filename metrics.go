@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * Metrics, exposed in the Prometheus text format
+ *
+ * /GET /metrics
+ */
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+var metrics []*counterVec
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+	metrics = append(metrics, c)
+	return c
+}
+
+var (
+	jobsSubmitted = newCounterVec("aniart_jobs_submitted_total", "Jobs queued for generation.", "type")
+	jobsCoalesced = newCounterVec("aniart_jobs_coalesced_total", "Requests attached to an already queued or running job for the same artwork.", "type")
+	jobsFinished  = newCounterVec("aniart_jobs_finished_total", "Jobs that finished, by final state.", "type", "state")
+	sourceFetches = newCounterVec("aniart_source_fetches_total", "Source image fetches, by result: downloaded, cached or failed.", "result")
+)
+
+// inc increments the counter for the given label values, which must match
+// the labels the counter was declared with.
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(values, "\x00")]++
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		values := strings.Split(key, "\x00")
+		pairs := make([]string, len(c.labels))
+		for i, label := range c.labels {
+			pairs[i] = fmt.Sprintf("%s=%q", label, values[i])
+		}
+		fmt.Fprintf(b, "%s{%s} %d\n", c.name, strings.Join(pairs, ","), c.values[key])
+	}
+}
+
+func getMetrics(c *gin.Context) {
+	var b strings.Builder
+	for _, metric := range metrics {
+		metric.write(&b)
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Content negotiation for animated artwork
+ *
+ * GET /artwork/:key without an extension serves the rendition the client's
+ * Accept header prefers among the ones that exist. Formats the client names
+ * explicitly win over ones it only accepts through a wildcard, and among
+ * equally acceptable formats the smallest is preferred.
+ */
+
+// preferredFormats is the order equally acceptable, explicitly named formats
+// are served in, smallest first.
+var preferredFormats = []string{"avif", "webp", "mp4", "apng", "gif"}
+
+type acceptRange struct {
+	mediaType string // type/subtype, either may be *
+	q         float64
+}
+
+// parseAccept parses an Accept header. Ranges that don't parse are skipped.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(raw, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality ranges gives contentType, from the most
+// specific range that matches it, and whether that range named it exactly.
+// Without any ranges everything is acceptable.
+func acceptQuality(ranges []acceptRange, contentType string) (float64, bool) {
+	if len(ranges) == 0 {
+		return 1, false
+	}
+	mainType, _, _ := strings.Cut(contentType, "/")
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		var s int
+		switch r.mediaType {
+		case contentType:
+			s = 2
+		case mainType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q, specificity == 2
+}
+
+type negotiatedFile struct {
+	*outputFormat
+	q     float64
+	exact bool
+}
+
+// negotiateArtwork returns the files acceptable according to the Accept
+// header, best first.
+func negotiateArtwork(files []*outputFormat, accept string) []negotiatedFile {
+	ranges := parseAccept(accept)
+	var acceptable []negotiatedFile
+	for _, f := range files {
+		if q, exact := acceptQuality(ranges, f.contentType); q > 0 {
+			acceptable = append(acceptable, negotiatedFile{f, q, exact})
+		}
+	}
+
+	// Wildcard matches keep the order of outputFormats, so clients that
+	// accept anything still get the GIF they always did
+	order := func(f negotiatedFile) int {
+		if f.exact {
+			return slices.Index(preferredFormats, f.name)
+		}
+		return len(preferredFormats) + slices.Index(outputFormats, f.outputFormat)
+	}
+	sort.SliceStable(acceptable, func(i, j int) bool {
+		if acceptable[i].q != acceptable[j].q {
+			return acceptable[i].q > acceptable[j].q
+		}
+		return order(acceptable[i]) < order(acceptable[j])
+	})
+	return acceptable
+}
+
+// renditionOf returns the payload that generates the artwork with key in
+// format, from the same source and with the same parameters as the renditions
+// that already exist. Like any other artwork, the rendition is stored under
+// the key of its own parameters.
+func renditionOf(key, format string) (GenerateArtworkPayload, error) {
+	meta, err := readArtworkMetadata(key)
+	if err != nil {
+		return GenerateArtworkPayload{}, fmt.Errorf("no metadata to generate %s from: %w", format, err)
+	}
+	preset, err := lookupPreset(defaultPresetFor(format))
+	if err != nil {
+		return GenerateArtworkPayload{}, err
+	}
+
+	params := meta.Params
+	params.Preset = defaultPresetFor(format)
+	params.Format = preset.Format
+	return GenerateArtworkPayload{URL: meta.URL, Key: animatedKey(meta.URL, params), Params: params}, nil
+}
+
+// renditionKey returns the key the artwork with key is stored under in f, or
+// "" if it doesn't exist in f.
+func renditionKey(key string, f *outputFormat) (string, error) {
+	if _, err := os.Stat(f.path(key)); err == nil {
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	payload, err := renditionOf(key, f.name)
+	if err != nil {
+		// Artwork from before there was metadata has no other renditions
+		return "", nil
+	}
+	if _, err := os.Stat(f.path(payload.Key)); os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return payload.Key, nil
+}
+
+// generateRendition queues generation of the artwork with key in format, see
+// renditionOf. It returns the ID of the job.
+func generateRendition(key, format string) (string, error) {
+	payload, err := renditionOf(key, format)
+	if err != nil {
+		return "", err
+	}
+	f := lookupFormat(payload.Params.Format)
+
+	payload.JobID = newJobID()
+	jobID, _, err := jobs.submit(payload.JobID, f.taskType, payload.Key, f.name, payload)
+	return jobID, err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseAccept(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   []acceptRange
+	}{
+		{"", nil},
+		{"image/webp", []acceptRange{{"image/webp", 1}}},
+		{"image/avif;q=0.9, image/*; q=0.5 ,*/*;q=0", []acceptRange{{"image/avif", 0.9}, {"image/*", 0.5}, {"*/*", 0}}},
+		// Ranges that don't parse are skipped, the rest still count
+		{"image/webp;q=2, image/gif;q=abc, image/png;q, video/mp4;q=0.3", []acceptRange{{"video/mp4", 0.3}}},
+		{"IMAGE/WEBP", []acceptRange{{"image/webp", 1}}},
+	} {
+		if got := parseAccept(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAccept(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateArtwork(t *testing.T) {
+	for _, tt := range []struct {
+		accept string
+		want   []string
+	}{
+		// Anything goes, in the order of outputFormats
+		{"", []string{"gif", "webp", "mp4", "avif", "apng"}},
+		{"*/*", []string{"gif", "webp", "mp4", "avif", "apng"}},
+		{"image/*", []string{"gif", "webp", "avif", "apng"}},
+		// Named formats beat wildcards, the smallest first
+		{"image/webp,image/avif,*/*", []string{"avif", "webp", "gif", "mp4", "apng"}},
+		{"image/gif,image/apng,image/webp,image/avif,video/mp4", []string{"avif", "webp", "mp4", "apng", "gif"}},
+		{"image/avif,image/*;q=0.8", []string{"avif", "gif", "webp", "apng"}},
+		// Quality beats everything else
+		{"image/webp;q=0.5,image/gif", []string{"gif", "webp"}},
+		{"image/avif;q=0.4,*/*;q=0.5", []string{"gif", "webp", "mp4", "apng", "avif"}},
+		// The most specific range decides, even if it refuses
+		{"image/gif;q=0,*/*", []string{"webp", "mp4", "avif", "apng"}},
+		{"image/*;q=0,video/mp4", []string{"mp4"}},
+		{"text/html", nil},
+	} {
+		var got []string
+		for _, f := range negotiateArtwork(servedFormats, tt.accept) {
+			got = append(got, f.name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestGetArtworkNegotiation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Animated.Presets = defaultPresets
+	cfg.PublishedURI = "http://aniart.test"
+	liveConfig.Store(cfg)
+	saved := animatedArt
+	animatedArt = t.TempDir()
+	t.Cleanup(func() { animatedArt = saved })
+
+	// Only the GIF has been generated so far
+	const url = "https://mvod.itunes.apple.com/itunes-assets/master.m3u8"
+	params := defaultAnimatedParams("gif", defaultPresets["gif"])
+	key := animatedKey(url, params)
+	if err := os.WriteFile(lookupFormat("gif").path(key), []byte("GIF89a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateArtworkMetadata(key, func(meta *artworkMetadata) {
+		meta.URL, meta.Preset, meta.Format, meta.Params = url, "gif", "gif", params
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	generated := make(chan GenerateArtworkPayload, 10)
+	useJobs(t, map[string]jobHandler{
+		TypeGenerateAltArtwork: func(ctx context.Context, job *Job) error {
+			var payload GenerateArtworkPayload
+			json.Unmarshal(job.Payload, &payload)
+			generated <- payload
+			return nil
+		},
+	})
+	// wantGenerated waits for the job generating format, or makes sure there
+	// is none if format is ""
+	wantGenerated := func(t *testing.T, format string) {
+		t.Helper()
+		wait := time.Second
+		if format == "" {
+			wait = 100 * time.Millisecond
+		}
+		select {
+		case payload := <-generated:
+			if payload.Params.Format != format || payload.URL != url {
+				t.Errorf("generated %s from %s, want %q", payload.Params.Format, payload.URL, format)
+			}
+		case <-time.After(wait):
+			if format != "" {
+				t.Errorf("%s wasn't generated", format)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		name            string
+		accept          string
+		generateMissing bool
+		status          int
+		contentType     string
+		generated       string
+	}{
+		{name: "available", accept: "image/gif", status: http.StatusOK, contentType: "image/gif"},
+		{name: "wildcard", accept: "image/avif;q=0.9,*/*;q=0.8", status: http.StatusOK, contentType: "image/gif"},
+		{name: "nothing acceptable", accept: "image/webp", status: http.StatusNotAcceptable},
+		{name: "nothing acceptable yet", accept: "image/webp", generateMissing: true, status: http.StatusAccepted, generated: "webp"},
+		{name: "fallback while generating", accept: "image/avif,image/gif;q=0.5", generateMissing: true, status: http.StatusOK, contentType: "image/gif", generated: "avif"},
+		// Only explicit preferences are worth generating
+		{name: "wildcard doesn't generate", accept: "image/*", generateMissing: true, status: http.StatusOK, contentType: "image/gif"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			currentConfig().Animated.GenerateMissing = tt.generateMissing
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/artwork/"+key, nil)
+			c.Request.Header.Set("Accept", tt.accept)
+			c.Params = gin.Params{{Key: "key", Value: key}}
+			getArtwork(c)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); tt.contentType != "" && got != tt.contentType {
+				t.Errorf("content type %s, want %s", got, tt.contentType)
+			}
+			if w.Header().Get("Vary") != "Accept" {
+				t.Errorf("Vary = %q", w.Header().Get("Vary"))
+			}
+			if tt.status == http.StatusAccepted {
+				var body struct {
+					JobID  string `json:"job_id"`
+					Status string `json:"status"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &body)
+				if body.JobID == "" || body.Status != "http://aniart.test/jobs/"+body.JobID {
+					t.Errorf("body = %s", w.Body)
+				}
+			}
+			wantGenerated(t, tt.generated)
+		})
+	}
+}
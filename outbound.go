@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+ * Outbound HTTP
+ *
+ * Every fetch of a source URL goes through a client that:
+ *  - checks each request, including every redirect hop, against the URL policy
+ *  - only connects to addresses that pass the network rules in OUTBOUND, which
+ *    refuse private, loopback and link-local addresses by default. The address
+ *    is checked after resolution and then dialled directly, so a DNS answer
+ *    can't change between the check and the connection.
+ *
+ * ffmpeg doesn't fetch source URLs itself, it goes through the media
+ * playlist proxy in mediaproxy.go, which uses the same client.
+ */
+
+// Resolver looks up the addresses of a host. net.DefaultResolver implements
+// it, tests can substitute a fake.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ErrForbiddenAddress is returned when a host only resolves to addresses the
+// network rules don't allow.
+var ErrForbiddenAddress = errors.New("address not allowed")
+
+// reservedNetworks are not covered by the net.IP helpers but must not be
+// reachable either.
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",       // "this" network
+	"100.64.0.0/10",   // carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // TEST-NET-1
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // TEST-NET-2
+	"203.0.113.0/24",  // TEST-NET-3
+	"240.0.0.0/4",     // reserved, includes broadcast
+	"64:ff9b::/96",    // NAT64, can map onto private IPv4
+	"2001:db8::/32",   // documentation
+	"fec0::/10",       // site-local
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// isPublicIP reports whether ip is a globally routable unicast address.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// outboundDialer resolves hosts itself and only connects to addresses the
+// network rules allow.
+type outboundDialer struct {
+	resolver Resolver
+	rules    func() OutboundConfig
+	dialer   net.Dialer
+}
+
+func (d *outboundDialer) allowed(ip net.IP) bool {
+	rules := d.rules()
+	if rules.AllowPrivateNetworks || isPublicIP(ip) {
+		return true
+	}
+	for _, cidr := range rules.AllowedNetworks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the allowed addresses for host, or ErrForbiddenAddress if
+// there are none.
+func (d *outboundDialer) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	var candidates []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		candidates = []net.IP{ip}
+	} else {
+		addrs, err := d.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			candidates = append(candidates, addr.IP)
+		}
+	}
+
+	var allowed []net.IP
+	for _, ip := range candidates {
+		if d.allowed(ip) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%s: %w", host, ErrForbiddenAddress)
+	}
+	return allowed, nil
+}
+
+func (d *outboundDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// policyTransport checks every request against a URL policy before sending
+// it, which covers redirects as well since each hop is a new request.
+type policyTransport struct {
+	policy URLPolicy
+	base   http.RoundTripper
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policy.Check(req.URL); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+func newOutboundTransport(dialer *outboundDialer) *http.Transport {
+	return &http.Transport{
+		// No proxy, a proxy would connect on our behalf and bypass the dialer
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+var (
+	sourceDialer = &outboundDialer{
+		resolver: net.DefaultResolver,
+		rules:    func() OutboundConfig { return currentConfig().Outbound },
+		dialer:   net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second},
+	}
+	sourceTransport = newOutboundTransport(sourceDialer)
+)
+
+// newOutboundClient returns a client for fetching URLs allowed by policy.
+// Clients share one transport, so connections are reused between them.
+func newOutboundClient(policy URLPolicy, transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: &policyTransport{policy: policy, base: transport},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if max := currentConfig().Outbound.MaxRedirects; len(via) > max {
+				return fmt.Errorf("stopped after %d redirects", max)
+			}
+			return nil
+		},
+	}
+}
+
+// sourceClient returns the client source URLs for endpoint are fetched with.
+func sourceClient(endpoint string) *http.Client {
+	return newOutboundClient(urlPolicyFor(endpoint), sourceTransport)
+}
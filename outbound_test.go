@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeResolver answers lookups from a table. A host with several answers
+// gets the next one on every lookup, the last one repeating, which is how a
+// DNS rebinding attack looks to the dialer.
+type fakeResolver struct {
+	mu      sync.Mutex
+	answers map[string][]string
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	answers := r.answers[host]
+	if len(answers) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	ip := answers[0]
+	if len(answers) > 1 {
+		r.answers[host] = answers[1:]
+	}
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+// testOutbound is an outbound client that allows the hosts in answers on
+// port, and the loopback address 127.0.0.1 but no other private address.
+type testOutbound struct {
+	client *http.Client
+	policy URLPolicy
+	dialer *outboundDialer
+}
+
+func newTestOutbound(t *testing.T, port int, answers map[string][]string) testOutbound {
+	t.Helper()
+	liveConfig.Store(defaultConfig())
+
+	hosts := make([]string, 0, len(answers))
+	for host := range answers {
+		hosts = append(hosts, host)
+	}
+	dialer := &outboundDialer{
+		resolver: &fakeResolver{answers: answers},
+		rules:    func() OutboundConfig { return OutboundConfig{AllowedNetworks: []string{"127.0.0.1/32"}} },
+	}
+	transport := newOutboundTransport(dialer)
+	// Every request dials again, so every request resolves again
+	transport.DisableKeepAlives = true
+	policy := newAllowlistPolicy(URLPolicyConfig{Schemes: []string{"http"}, Hosts: hosts, Ports: []int{port}}, URLPolicyConfig{})
+	return testOutbound{client: newOutboundClient(policy, transport), policy: policy, dialer: dialer}
+}
+
+func serverPort(t *testing.T, srv *httptest.Server) int {
+	t.Helper()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func get(client *http.Client, rawURL string) (int, string, error) {
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+func TestOutboundDialerAllowed(t *testing.T) {
+	dialer := &outboundDialer{rules: func() OutboundConfig { return OutboundConfig{AllowedNetworks: []string{"10.1.0.0/16"}} }}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"17.253.144.10", true},
+		{"2a01:b740:a42::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true}, // in ALLOWED_NETWORKS
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::7f00:1", false},
+	} {
+		if got := dialer.allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestOutboundClientChecksRedirects(t *testing.T) {
+	var internalHits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			fmt.Fprint(w, "ok")
+		case "/to-internal":
+			http.Redirect(w, r, "http://internal.test:"+strings.Split(r.Host, ":")[1]+"/secret", http.StatusFound)
+		case "/to-elsewhere":
+			http.Redirect(w, r, "http://elsewhere.test/", http.StatusFound)
+		case "/v/huge.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXTINF:2,\nseg0.m4s\n")
+			for i := 0; i < maxPlaylistBytes/10; i++ {
+				fmt.Fprint(w, "#EXTINF:2,\nseg0.m4s\n")
+			}
+		case "/secret":
+			internalHits.Add(1)
+			fmt.Fprint(w, "secret")
+		}
+	}))
+	defer srv.Close()
+	port := serverPort(t, srv)
+	out := newTestOutbound(t, port, map[string][]string{
+		"cdn.test":      {"127.0.0.1"},
+		"internal.test": {"127.0.0.2"},
+	})
+	base := fmt.Sprintf("http://cdn.test:%d", port)
+
+	if status, body, err := get(out.client, base+"/ok"); err != nil || status != http.StatusOK || body != "ok" {
+		t.Fatalf("GET /ok = %d %q, %v", status, body, err)
+	}
+
+	_, _, err := get(out.client, base+"/to-internal")
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("redirect to a loopback address: err = %v, want ErrForbiddenAddress", err)
+	}
+
+	_, _, err = get(out.client, base+"/to-elsewhere")
+	var rejected *URLRejectedError
+	if !errors.As(err, &rejected) {
+		t.Errorf("redirect to a host outside the policy: err = %v, want URLRejectedError", err)
+	}
+
+	if internalHits.Load() != 0 {
+		t.Errorf("internal address was reached %d times", internalHits.Load())
+	}
+}
+
+func TestOutboundDialerRechecksEveryConnection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	port := serverPort(t, srv)
+	// Allowed at first, then rebound to another loopback address
+	out := newTestOutbound(t, port, map[string][]string{"cdn.test": {"127.0.0.1", "127.0.0.2"}})
+	u := fmt.Sprintf("http://cdn.test:%d/", port)
+
+	if _, _, err := get(out.client, u); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, _, err := get(out.client, u); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("after rebinding: err = %v, want ErrForbiddenAddress", err)
+	}
+}
+
+func TestMediaProxy(t *testing.T) {
+	var internalHits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		port := strings.Split(r.Host, ":")[1]
+		switch r.URL.Path {
+		case "/v/media.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2,\nseg0.m4s\n#EXTINF:2,\n/v/seg1.m4s\n#EXT-X-ENDLIST\n")
+		case "/v/init.mp4":
+			fmt.Fprint(w, "init")
+		case "/v/seg0.m4s":
+			if r.Header.Get("Range") == "bytes=0-3" {
+				w.Header().Set("Content-Range", "bytes 0-3/8")
+				w.WriteHeader(http.StatusPartialContent)
+				fmt.Fprint(w, "seg0")
+				return
+			}
+			fmt.Fprint(w, "seg0seg0")
+		case "/v/seg1.m4s":
+			http.Redirect(w, r, "http://internal.test:"+port+"/secret", http.StatusFound)
+		case "/nested.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nhttp://internal.test:"+port+"/secret\n")
+		case "/v/nested-segment.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXTINF:2,\nmore.m3u8\n")
+		case "/v/more.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXTINF:2,\nhttp://internal.test:"+port+"/secret\n")
+		case "/v/elsewhere.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXTINF:2,\nhttp://elsewhere.test/seg.ts\n")
+		case "/v/internal.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXTINF:2,\nhttp://internal.test:"+port+"/secret\n")
+		case "/v/huge.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXTINF:2,\nseg0.m4s\n")
+			for i := 0; i < maxPlaylistBytes/10; i++ {
+				fmt.Fprint(w, "#EXTINF:2,\nseg0.m4s\n")
+			}
+		case "/secret":
+			internalHits.Add(1)
+			fmt.Fprint(w, "secret")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	port := serverPort(t, srv)
+	out := newTestOutbound(t, port, map[string][]string{
+		"cdn.test":      {"127.0.0.1"},
+		"internal.test": {"127.0.0.2"},
+	})
+	base := fmt.Sprintf("http://cdn.test:%d", port)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("rewrites and proxies", func(t *testing.T) {
+		proxy, err := startMediaProxy(ctx, out.client, out.policy, out.dialer, base+"/v/media.m3u8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxy.Close()
+		// ffmpeg talks to the proxy directly
+		plain := &http.Client{}
+
+		_, playlist, err := get(plain, proxy.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(playlist, "cdn.test") || strings.Contains(playlist, "\nseg0.m4s\n") {
+			t.Errorf("playlist still references the source:\n%s", playlist)
+		}
+		var uris []string
+		for _, line := range strings.Split(playlist, "\n") {
+			if uri, ok := strings.CutPrefix(line, `#EXT-X-MAP:URI="`); ok {
+				uris = append(uris, strings.TrimSuffix(uri, `"`))
+			} else if line != "" && !strings.HasPrefix(line, "#") {
+				uris = append(uris, line)
+			}
+		}
+		if len(uris) != 3 {
+			t.Fatalf("got URIs %q, want 3", uris)
+		}
+		for i, uri := range uris {
+			if !strings.HasPrefix(uri, proxy.prefix) {
+				t.Errorf("URI %d = %q, not on the proxy", i, uri)
+			}
+		}
+		root := "http://" + proxy.listener.Addr().String()
+
+		if status, body, _ := get(plain, root+uris[0]); status != http.StatusOK || body != "init" {
+			t.Errorf("init = %d %q", status, body)
+		}
+		req, _ := http.NewRequest(http.MethodGet, root+uris[1], nil)
+		req.Header.Set("Range", "bytes=0-3")
+		resp, err := plain.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || string(body) != "seg0" || resp.Header.Get("Content-Range") != "bytes 0-3/8" {
+			t.Errorf("ranged seg0 = %d %q %q", resp.StatusCode, body, resp.Header.Get("Content-Range"))
+		}
+		// The segment redirects to a loopback address
+		if status, _, _ := get(plain, root+uris[2]); status != http.StatusBadGateway {
+			t.Errorf("seg1 = %d, want %d", status, http.StatusBadGateway)
+		}
+		if status, _, _ := get(plain, root+"/other/0/init.mp4"); status != http.StatusNotFound {
+			t.Errorf("path outside the prefix = %d, want %d", status, http.StatusNotFound)
+		}
+	})
+
+	t.Run("refuses nested playlists", func(t *testing.T) {
+		proxy, err := startMediaProxy(ctx, out.client, out.policy, out.dialer, base+"/v/nested-segment.m3u8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxy.Close()
+		_, playlist, _ := get(&http.Client{}, proxy.URL())
+		segment := strings.Split(strings.TrimSpace(playlist), "\n")[2]
+		if status, _, _ := get(&http.Client{}, "http://"+proxy.listener.Addr().String()+segment); status != http.StatusBadGateway {
+			t.Errorf("nested playlist = %d, want %d", status, http.StatusBadGateway)
+		}
+	})
+
+	for _, tt := range []struct {
+		name, path string
+		check      func(error) bool
+	}{
+		{"master playlist", "/nested.m3u8", func(err error) bool { return errors.Is(err, ErrNotMediaPlaylist) }},
+		{"host outside the policy", "/v/elsewhere.m3u8", func(err error) bool {
+			var rejected *URLRejectedError
+			return errors.As(err, &rejected)
+		}},
+		{"private address", "/v/internal.m3u8", func(err error) bool { return errors.Is(err, ErrForbiddenAddress) }},
+		{"oversized playlist", "/v/huge.m3u8", func(err error) bool { return errors.Is(err, ErrPlaylistTooLarge) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := startMediaProxy(ctx, out.client, out.policy, out.dialer, base+tt.path)
+			if !tt.check(err) {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+
+	if internalHits.Load() != 0 {
+		t.Errorf("internal address was reached %d times", internalHits.Load())
+	}
+}
+
+func TestReadPlaylist(t *testing.T) {
+	for _, tt := range []struct {
+		size int
+		want error
+	}{
+		{0, nil},
+		{maxPlaylistBytes, nil},
+		{maxPlaylistBytes + 1, ErrPlaylistTooLarge},
+		{2 * maxPlaylistBytes, ErrPlaylistTooLarge},
+	} {
+		data, err := readPlaylist(strings.NewReader(strings.Repeat("#", tt.size)))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%d bytes: err = %v, want %v", tt.size, err, tt.want)
+		} else if err == nil && len(data) != tt.size {
+			t.Errorf("%d bytes: read %d", tt.size, len(data))
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+/*
+ * Animated artwork parameters
+ *
+ * /GET /artwork/generate?url=...&preset=gif&width=256&fps=15&duration=5&start=2&loop=0
+ *
+ * Every parameter is optional, the preset provides the defaults for the
+ * others. Artwork generated with anything other than the defaults is stored
+ * under its own key, see animatedKey.
+ */
+
+// AnimatedParams are the per-request options for animated artwork. Times are
+// in seconds.
+type AnimatedParams struct {
+	Preset string `json:"preset"`
+	// Format is the preset's FORMAT at the time of the request
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	// FPS is the output frame rate, 0 keeps the source's
+	FPS int `json:"fps"`
+	// Duration is the most that is kept after Start, 0 keeps everything. It
+	// is never 0 while there is a duration limit, see durationLimit.
+	Duration float64 `json:"duration"`
+	Start    float64 `json:"start"`
+	// Loop is how many times the animation repeats, 0 forever, -1 plays once
+	Loop int `json:"loop"`
+}
+
+// defaultAnimatedParams returns the parameters used when a request only
+// names preset.
+func defaultAnimatedParams(name string, preset PresetConfig) AnimatedParams {
+	params := AnimatedParams{
+		Preset:   name,
+		Format:   preset.Format,
+		Width:    preset.Width,
+		FPS:      preset.FPS,
+		Duration: durationLimit(preset),
+	}
+	if params.Width == 0 {
+		params.Width = currentConfig().Animated.Width
+	}
+	return params
+}
+
+// parseAnimatedParams reads the parameters for artwork in one of formats
+// from the query string and checks them against the limits in ANIMATED. The
+// first format's preset is the default.
+func parseAnimatedParams(c *gin.Context, formats ...string) (AnimatedParams, error) {
+	name := c.DefaultQuery("preset", defaultPresetFor(formats[0]))
+	preset, err := lookupPreset(name)
+	if err != nil {
+		return AnimatedParams{}, err
+	}
+	if !slices.Contains(formats, preset.Format) {
+		return AnimatedParams{}, fmt.Errorf("preset %q produces %s, this endpoint only produces %s", name, preset.Format, strings.Join(formats, " or "))
+	}
+
+	params := defaultAnimatedParams(name, preset)
+	cfg := currentConfig().Animated
+
+	parseInt := func(name string, dst *int) error {
+		if raw, ok := c.GetQuery(name); ok {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return fmt.Errorf("%s must be a whole number, got %q", name, raw)
+			}
+			*dst = n
+		}
+		return nil
+	}
+	parseSeconds := func(name string, dst *float64) error {
+		if raw, ok := c.GetQuery(name); ok {
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+				return fmt.Errorf("%s must be a number of seconds, got %q", name, raw)
+			}
+			*dst = n
+		}
+		return nil
+	}
+	for _, err := range []error{
+		parseInt("width", &params.Width),
+		parseInt("fps", &params.FPS),
+		parseSeconds("duration", &params.Duration),
+		parseSeconds("start", &params.Start),
+		parseInt("loop", &params.Loop),
+	} {
+		if err != nil {
+			return params, err
+		}
+	}
+
+	// Presets without a WIDTH have 0, which is never a width
+	allowed := params.Width == cfg.Width || (preset.Width > 0 && params.Width == preset.Width) || slices.Contains(cfg.AllowedWidths, params.Width)
+	if params.Width <= 0 || !allowed {
+		return params, fmt.Errorf("width must be one of %v", append([]int{cfg.Width}, cfg.AllowedWidths...))
+	}
+	if params.FPS < 0 || params.FPS > cfg.MaxFPS {
+		return params, fmt.Errorf("fps must be between 0 and %d, 0 keeps the source frame rate", cfg.MaxFPS)
+	}
+	if params.Duration < 0 || (cfg.MaxDuration > 0 && params.Duration > cfg.MaxDuration.Seconds()) {
+		return params, fmt.Errorf("duration must be between 0 and %g seconds", cfg.MaxDuration.Seconds())
+	}
+	if params.Start < 0 {
+		return params, fmt.Errorf("start must not be negative")
+	}
+	if params.Loop < -1 || params.Loop > 65535 {
+		return params, fmt.Errorf("loop must be between -1 and 65535")
+	}
+
+	// Formats that don't loop by themselves ignore it, so it mustn't make
+	// a key of its own
+	if format := lookupFormat(params.Format); format != nil && format.loopArgs == nil {
+		params.Loop = 0
+	}
+
+	// The preset's limit wins over the request, and asking for everything
+	// only gets as much as the limits allow
+	if limit := durationLimit(preset); limit > 0 && (params.Duration == 0 || params.Duration > limit) {
+		params.Duration = limit
+	}
+
+	return params, nil
+}
+
+// durationLimit returns the most artwork in preset may keep in seconds, the
+// lower of the preset's MAX_DURATION and ANIMATED.MAX_DURATION. 0 is no limit.
+func durationLimit(preset PresetConfig) float64 {
+	limit := currentConfig().Animated.MaxDuration
+	if preset.MaxDuration > 0 && (limit == 0 || preset.MaxDuration < limit) {
+		limit = preset.MaxDuration
+	}
+	return limit.Seconds()
+}
+
+// animatedParams returns the payload's parameters. Jobs queued before there
+// were parameters have none, they get the defaults for format.
+func (p GenerateArtworkPayload) animatedParams(format string) AnimatedParams {
+	if p.Params.Preset == "" {
+		name := defaultPresetFor(format)
+		return defaultAnimatedParams(name, defaultPresets[name])
+	}
+	params := p.Params
+	if params.Format == "" {
+		params.Format = format
+	}
+	return params
+}
+
+// animatedKey returns the cache key for animated artwork from urlStr. The gif
+// and webp presets with their defaults keep the plain URL key, so artwork
+// generated before there were parameters is still found.
+func animatedKey(urlStr string, params AnimatedParams) string {
+	if params.Preset == "gif" || params.Preset == "webp" {
+		if preset, err := lookupPreset(params.Preset); err == nil && params == defaultAnimatedParams(params.Preset, preset) {
+			return generateKey(urlStr)
+		}
+	}
+	return generateKey(fmt.Sprintf("%s#preset=%s,w=%d,fps=%d,d=%g,ss=%g,loop=%d",
+		urlStr, params.Preset, params.Width, params.FPS, params.Duration, params.Start, params.Loop))
+}
+
+// ffmpegFilters returns the filter chain that resamples the video to the
+// requested frame rate and width, followed by the preset's own filters and
+// then the format's.
+func (p AnimatedParams) ffmpegFilters(preset PresetConfig, format *outputFormat) string {
+	// Video encoders need an even height
+	height := -1
+	if format.video {
+		height = -2
+	}
+	filters := fmt.Sprintf("scale=%d:%d:flags=lanczos", p.Width, height)
+	if p.FPS > 0 {
+		filters = fmt.Sprintf("fps=%d,%s", p.FPS, filters)
+	}
+	if preset.Filters != "" {
+		filters += "," + preset.Filters
+	}
+	if format.filters != "" {
+		filters += "," + format.filters
+	}
+	return filters
+}
+
+// inputArgs returns the ffmpeg input options for the trim start.
+func (p AnimatedParams) inputArgs() ffmpeg.KwArgs {
+	args := ffmpeg.KwArgs{}
+	if p.Start > 0 {
+		args["ss"] = strconv.FormatFloat(p.Start, 'f', -1, 64)
+	}
+	return args
+}
+
+// outputArgs returns the ffmpeg output options for the duration and loop
+// count in format.
+func (p AnimatedParams) outputArgs(format *outputFormat) ffmpeg.KwArgs {
+	args := ffmpeg.KwArgs{}
+	if format.loopArgs != nil {
+		args = format.loopArgs(p.Loop)
+	}
+	if p.Duration > 0 {
+		args["t"] = strconv.FormatFloat(p.Duration, 'f', -1, 64)
+	}
+	return args
+}
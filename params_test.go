@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseAnimatedParamsDuration(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Animated.MaxDuration = time.Minute
+	cfg.Animated.Presets = map[string]PresetConfig{
+		"gif":     defaultPresets["gif"],
+		"discord": {Format: "gif", MaxDuration: 10 * time.Second},
+		"long":    {Format: "gif", MaxDuration: 5 * time.Minute},
+	}
+	liveConfig.Store(cfg)
+
+	for _, tt := range []struct {
+		query   string
+		want    float64
+		wantErr bool
+	}{
+		{query: "", want: 60},
+		{query: "duration=0", want: 60},
+		{query: "duration=5", want: 5},
+		{query: "duration=60", want: 60},
+		{query: "duration=61", wantErr: true},
+		{query: "preset=discord", want: 10},
+		{query: "preset=discord&duration=30", want: 10},
+		{query: "preset=discord&duration=3", want: 3},
+		// The global limit applies to presets allowing more
+		{query: "preset=long", want: 60},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/artwork/generate?"+tt.query, nil)
+		params, err := parseAnimatedParams(c, "gif")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: no error, duration %g", tt.query, params.Duration)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if params.Duration != tt.want {
+			t.Errorf("%q: duration %g, want %g", tt.query, params.Duration, tt.want)
+		}
+	}
+
+	// Without a limit, nothing is clipped
+	cfg.Animated.MaxDuration = 0
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/artwork/generate", nil)
+	if params, err := parseAnimatedParams(c, "gif"); err != nil || params.Duration != 0 {
+		t.Errorf("without a limit: duration %g, %v", params.Duration, err)
+	}
+}
+
+func TestAnimatedKeyDefaults(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Animated.Presets = defaultPresets
+	liveConfig.Store(cfg)
+
+	// Requests that leave everything to the preset keep the plain URL key
+	const url = "https://mvod.itunes.apple.com/itunes-assets/master.m3u8"
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/artwork/generate", nil)
+	params, err := parseAnimatedParams(c, "gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := animatedKey(url, params); key != generateKey(url) {
+		t.Errorf("default gif got key %s, want the URL's %s", key, generateKey(url))
+	}
+}
+
+func TestParseAnimatedParamsWidth(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Animated.Width = 486
+	cfg.Animated.AllowedWidths = []int{256}
+	cfg.Animated.Presets = map[string]PresetConfig{
+		"gif":    defaultPresets["gif"],
+		"banner": {Format: "gif", Width: 1000},
+	}
+	liveConfig.Store(cfg)
+
+	for _, tt := range []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{query: "", want: 486},
+		{query: "width=486", want: 486},
+		{query: "width=256", want: 256},
+		{query: "width=300", wantErr: true},
+		// The built-in presets have WIDTH 0, which mustn't let 0 through
+		{query: "width=0", wantErr: true},
+		{query: "width=-256", wantErr: true},
+		{query: "preset=banner", want: 1000},
+		{query: "preset=banner&width=1000", want: 1000},
+		{query: "preset=banner&width=486", want: 486},
+		{query: "preset=banner&width=0", wantErr: true},
+		{query: "width=1000", wantErr: true},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/artwork/generate?"+tt.query, nil)
+		params, err := parseAnimatedParams(c, "gif")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: no error, width %d", tt.query, params.Width)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if params.Width != tt.want {
+			t.Errorf("%q: width %d, want %d", tt.query, params.Width, tt.want)
+		}
+	}
+}
+
+func TestAnimatedKeyIgnoresLoopForVideo(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Animated.Presets = defaultPresets
+	liveConfig.Store(cfg)
+
+	const url = "https://mvod.itunes.apple.com/itunes-assets/master.m3u8"
+	key := func(formats []string, query string) string {
+		t.Helper()
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/artwork/video?"+query, nil)
+		params, err := parseAnimatedParams(c, formats...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return animatedKey(url, params)
+	}
+
+	video := []string{"mp4", "hevc"}
+	if key(video, "loop=3") != key(video, "loop=0") || key(video, "preset=hevc&loop=-1") != key(video, "preset=hevc") {
+		t.Error("loop changes the key of a video")
+	}
+	if key([]string{"gif"}, "loop=3") == key([]string{"gif"}, "loop=0") {
+		t.Error("loop doesn't change the key of a gif")
+	}
+}
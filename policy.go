@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Source URL Policy
+ *
+ * Decides which URLs artwork may be generated from. The allowlist policy is
+ * built from URL_POLICY in the configuration, each endpoint can override it
+ * in its own section.
+ */
+
+const (
+	endpointAnimated     = "animated"
+	endpointArtistSquare = "artist_square"
+	endpointICloud       = "icloud"
+)
+
+// URLPolicy decides whether a source URL may be fetched. Check returns a
+// *URLRejectedError describing why a URL is not allowed.
+type URLPolicy interface {
+	Check(u *url.URL) error
+}
+
+type URLRejectedError struct {
+	URL    string
+	Reason string
+}
+
+func (e *URLRejectedError) Error() string {
+	return fmt.Sprintf("URL %s is not allowed: %s", e.URL, e.Reason)
+}
+
+type allowlistPolicy struct {
+	schemes []string
+	hosts   []string
+	ports   []int
+}
+
+// newAllowlistPolicy builds a policy from base, with any list set in
+// override replacing the one in base.
+func newAllowlistPolicy(base, override URLPolicyConfig) *allowlistPolicy {
+	p := &allowlistPolicy{
+		schemes: base.Schemes,
+		hosts:   base.Hosts,
+		ports:   base.Ports,
+	}
+	if len(override.Schemes) > 0 {
+		p.schemes = override.Schemes
+	}
+	if len(override.Hosts) > 0 {
+		p.hosts = override.Hosts
+	}
+	if len(override.Ports) > 0 {
+		p.ports = override.Ports
+	}
+	return p
+}
+
+func (p *allowlistPolicy) Check(u *url.URL) error {
+	reject := func(format string, args ...interface{}) error {
+		return &URLRejectedError{URL: u.Redacted(), Reason: fmt.Sprintf(format, args...)}
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if !slices.Contains(p.schemes, scheme) {
+		return reject("scheme %q is not allowed, allowed schemes: %s", u.Scheme, strings.Join(p.schemes, ", "))
+	}
+	if u.User != nil {
+		return reject("URLs with credentials are not allowed")
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return reject("missing host")
+	}
+	if !p.allowsHost(host) {
+		return reject("host %q is not allowed, allowed hosts: %s", host, strings.Join(p.hosts, ", "))
+	}
+
+	if port := u.Port(); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return reject("invalid port %q", port)
+		}
+		if n != defaultPort(scheme) && !slices.Contains(p.ports, n) {
+			return reject("port %d is not allowed", n)
+		}
+	}
+
+	return nil
+}
+
+func (p *allowlistPolicy) allowsHost(host string) bool {
+	for _, pattern := range p.hosts {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultPort(scheme string) int {
+	switch scheme {
+	case "http":
+		return 80
+	case "https":
+		return 443
+	default:
+		return 0
+	}
+}
+
+// urlPolicyFor returns the policy source URLs for endpoint are checked
+// against under the current configuration.
+func urlPolicyFor(endpoint string) URLPolicy {
+	cfg := currentConfig()
+	switch endpoint {
+	case endpointAnimated:
+		return newAllowlistPolicy(cfg.URLPolicy, cfg.Animated.URLPolicy)
+	case endpointArtistSquare:
+		return newAllowlistPolicy(cfg.URLPolicy, cfg.ArtistSquare.URLPolicy)
+	case endpointICloud:
+		return newAllowlistPolicy(cfg.URLPolicy, cfg.ICloud.URLPolicy)
+	default:
+		return newAllowlistPolicy(cfg.URLPolicy, URLPolicyConfig{})
+	}
+}
+
+// checkSourceURL parses rawURL and checks it against the policy for endpoint.
+func checkSourceURL(endpoint, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() {
+		return &URLRejectedError{URL: rawURL, Reason: "not a valid absolute URL"}
+	}
+	return urlPolicyFor(endpoint).Check(u)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+/*
+ * Encoding presets
+ *
+ * Animated artwork is encoded with a named preset from ANIMATED.PRESETS,
+ * chosen with the preset query parameter. The built-in gif and webp presets
+ * are the defaults of /artwork/generate and /artwork/generate_alt.
+ */
+
+// defaultPresets is merged into ANIMATED.PRESETS after the config file is
+// read, so the defaults can be changed but not removed.
+var defaultPresets = map[string]PresetConfig{
+	"gif": {
+		Format:  "gif",
+		Options: map[string]string{"preset": "fast"},
+	},
+	"webp": {
+		Format:  "webp",
+		Codec:   "libwebp",
+		Quality: 80,
+		Options: map[string]string{"preset": "photo", "compression_level": "4"},
+	},
+	"avif": {
+		Format:  "avif",
+		Codec:   "libaom-av1",
+		Options: map[string]string{"crf": "32", "cpu-used": "6", "row-mt": "1"},
+	},
+	"apng": {
+		Format: "apng",
+		Codec:  "apng",
+	},
+	"mp4": {
+		Format:  "mp4",
+		Codec:   "libx264",
+		Options: map[string]string{"preset": "medium", "crf": "23"},
+	},
+	"hevc": {
+		Format:  "hevc",
+		Codec:   "libx265",
+		Options: map[string]string{"preset": "medium", "crf": "28"},
+	},
+}
+
+// defaultPresetFor returns the preset used for format when the request
+// doesn't name one.
+func defaultPresetFor(format string) string {
+	return format
+}
+
+// lookupPreset returns the preset called name from the current config.
+func lookupPreset(name string) (PresetConfig, error) {
+	preset, ok := currentConfig().Animated.Presets[name]
+	if !ok {
+		return PresetConfig{}, fmt.Errorf("unknown preset %q", name)
+	}
+	return preset, nil
+}
+
+// outputArgs returns the ffmpeg output options for the preset's encoder in
+// format. Options from the config come first so they can't override the ones
+// the preset fields or the format set.
+func (p PresetConfig) outputArgs(format *outputFormat) ffmpeg.KwArgs {
+	args := ffmpeg.KwArgs{}
+	for name, value := range p.Options {
+		args[name] = value
+	}
+	if p.Codec != "" {
+		args["c:v"] = p.Codec
+	}
+	for name, value := range format.args {
+		args[name] = value
+	}
+	if p.Quality > 0 && format.quality != "" {
+		args[format.quality] = strconv.Itoa(p.Quality)
+	}
+	return args
+}
+
+// artworkMetadata is stored next to generated animated artwork as
+// <key>.json, recording what it was generated from and how. The top level
+// describes the most recent rendition, Renditions each file by extension.
+type artworkMetadata struct {
+	URL        string                       `json:"url"`
+	Preset     string                       `json:"preset"`
+	Format     string                       `json:"format"`
+	Params     AnimatedParams               `json:"params"`
+	CreatedAt  time.Time                    `json:"created_at"`
+	Renditions map[string]renditionMetadata `json:"renditions,omitempty"`
+}
+
+// renditionMetadata describes one generated file, as probed after encoding.
+type renditionMetadata struct {
+	Preset string `json:"preset"`
+	Format string `json:"format"`
+	MediaInfo
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// readArtworkMetadata reads the metadata stored for the animated artwork
+// with key, see writeArtworkMetadata.
+func readArtworkMetadata(key string) (artworkMetadata, error) {
+	var meta artworkMetadata
+	data, err := os.ReadFile(filepath.Join(animatedArt, fmt.Sprintf("%s.json", key)))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// metadataMu serialises updates of metadata files, renditions of the same key
+// may finish at the same time.
+var metadataMu sync.Mutex
+
+// updateArtworkMetadata applies update to the metadata stored for the
+// animated artwork with key and stores the result. Metadata that is missing
+// or unreadable is started over.
+func updateArtworkMetadata(key string, update func(meta *artworkMetadata)) error {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+
+	meta, err := readArtworkMetadata(key)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warnf("Replacing unreadable metadata for %s: %v", key, err)
+		meta = artworkMetadata{}
+	}
+	if meta.Renditions == nil {
+		meta.Renditions = make(map[string]renditionMetadata)
+	}
+	update(&meta)
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(animatedArt, fmt.Sprintf("%s_temp.json", key))
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(animatedArt, fmt.Sprintf("%s.json", key)))
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image"
-	"image/draw"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,220 +18,210 @@ import (
 	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
-var (
-	configURI = getBaseURI()
-)
-
-/*
- * Animated Artwork Processing (Alt, WEBP format instead of GIF, experimental.)
- *
- * /POST /artwork/generate_alt
- */
-
-func generateAltArtworkAsync(urlStr, key, webpPath string) error {
-	tempWebpPath := filepath.Join(animatedArt, fmt.Sprintf("%s_temp.webp", key))
-
-	defer func() {
-		if _, err := os.Stat(tempWebpPath); err == nil {
-			logger.Infof("Cleaning up temporary file %s", tempWebpPath)
-			if err := os.Remove(tempWebpPath); err != nil {
-				logger.Errorf("Failed to remove temporary file %s: %v", tempWebpPath, err)
-			}
-		}
-	}()
-
-	// Parse the m3u8 file
-	streamURL, err := getHighQualityStreamURL(urlStr)
-	if err != nil {
-		return fmt.Errorf("failed to get high quality stream URL: %w", err)
+// queueErrorStatus maps an error from jobs.submit to a response status.
+func queueErrorStatus(err error) int {
+	if errors.Is(err, ErrShuttingDown) {
+		return http.StatusServiceUnavailable
 	}
-
-	err = ffmpeg.Input(streamURL).
-		Output(tempWebpPath, ffmpeg.KwArgs{
-			"vf":                "scale=486:-1:flags=lanczos", // No need for palette generation for WEBP
-			"loop":              "0",                          // Loop infinitely
-			"threads":           "8",
-			"preset":            "photo", // Use photo preset for better quality
-			"multiple_requests": "1",
-			"buffer_size":       "8192k",
-			"loglevel":          "panic",
-			"c:v":               "libwebp", // Use WEBP codec
-			"quality":           "80",      // WEBP quality (0-100)
-			"compression_level": "4",       // WEBP compression level (0-6)
-		}).
-		GlobalArgs("-hide_banner").
-		OverWriteOutput().
-		ErrorToStdOut().
-		Run()
-
-	if err != nil {
-		logger.Errorf("FFmpeg error: %v", err)
-		return fmt.Errorf("ffmpeg command failed: %w", err)
-	}
-
-	if fi, err := os.Stat(tempWebpPath); err != nil || fi.Size() == 0 {
-		logger.Errorf("Temporary file %s was not created or is empty", tempWebpPath)
-		return fmt.Errorf("ffmpeg failed to create output file")
-	}
-
-	if err := os.Rename(tempWebpPath, webpPath); err != nil {
-		logger.Errorf("Error renaming file: %v", err)
-		return fmt.Errorf("error renaming file: %w", err)
-	}
-
-	return nil
+	return http.StatusInternalServerError
 }
 
-func generateAltArtwork(c *gin.Context) {
-	urlStr := c.Query("url")
-	if urlStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "URL query parameter is required"})
-		return
-	}
-
-	if err := isValidAppleURL(urlStr); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	key := generateKey(urlStr)
-	webpPath := filepath.Join(animatedArt, fmt.Sprintf("%s.webp", key))
+// jobErrorStatus maps the error a job failed with to a response status, for
+// failures caused by the source rather than by us. Anything else is 0.
+func jobErrorStatus(err error) int {
+	var tooLarge *ImageTooLargeError
+	var unsupported *UnsupportedMediaTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &unsupported):
+		return http.StatusUnsupportedMediaType
+	}
+	return 0
+}
 
-	if _, err := os.Stat(webpPath); err == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"key":     key,
-			"message": "WEBP already exists",
-			"url":     fmt.Sprintf("%s/artwork/%s.webp", configURI, key),
-		})
+// respondJobFailed responds for a job that failed. The error is passed on if
+// it was the source's fault, otherwise the client only gets message.
+func respondJobFailed(c *gin.Context, job *Job, message string) {
+	if job.ErrorStatus != 0 {
+		c.JSON(job.ErrorStatus, gin.H{"error": job.Error, "job_id": job.ID})
 		return
 	}
-
-	resultChan := make(chan error)
-
-	go func() {
-		err := generateAltArtworkAsync(urlStr, key, webpPath)
-		resultChan <- err
-	}()
-
-	select {
-	case err := <-resultChan:
-		if err != nil {
-			logger.Errorf("Failed to generate artwork: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate artwork"})
-		} else {
-			c.JSON(http.StatusOK, gin.H{
-				"key":     key,
-				"message": "WEBP has been generated",
-				"url":     fmt.Sprintf("%s/artwork/%s.webp", configURI, key),
-			})
-		}
-	case <-time.After(30 * time.Second):
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "WEBP generation timed out"})
-	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message, "job_id": job.ID})
 }
 
 /*
  * Animated Artwork Processing
  *
- * /POST /artwork/generate
+ * /GET /artwork/generate        GIF
+ * /GET /artwork/generate_alt    WEBP, AVIF or APNG
+ * /GET /artwork/generate_video  MP4, H.264 or HEVC
+ *
+ * One pipeline for every format, what differs between them is in their
+ * outputFormat.
  */
 
-func generateArtworkAsync(urlStr, key, gifPath string) error {
-	tempGifPath := filepath.Join(animatedArt, fmt.Sprintf("%s_temp.gif", key))
+func generateAnimatedArtworkAsync(ctx context.Context, urlStr, key string, params AnimatedParams) error {
+	format := lookupFormat(params.Format)
+	if format == nil {
+		return fmt.Errorf("unknown format %q", params.Format)
+	}
+	tempPath := filepath.Join(animatedArt, fmt.Sprintf("%s_temp.%s", key, format.ext))
 
 	defer func() {
-		if _, err := os.Stat(tempGifPath); err == nil {
-			logger.Infof("Cleaning up temporary file %s", tempGifPath)
-			if err := os.Remove(tempGifPath); err != nil {
-				logger.Errorf("Failed to remove temporary file %s: %v", tempGifPath, err)
+		if _, err := os.Stat(tempPath); err == nil {
+			logger.Infof("Cleaning up temporary file %s", tempPath)
+			if err := os.Remove(tempPath); err != nil {
+				logger.Errorf("Failed to remove temporary file %s: %v", tempPath, err)
 			}
 		}
 	}()
 
+	preset, err := lookupPreset(params.Preset)
+	if err != nil {
+		return err
+	}
+	if preset.Format != params.Format {
+		return fmt.Errorf("preset %q was changed from %s to %s", params.Preset, params.Format, preset.Format)
+	}
+
 	// Parse the m3u8 file
-	streamURL, err := getHighQualityStreamURL(urlStr)
+	streamURL, err := getHighQualityStreamURL(ctx, urlStr, params.Width)
 	if err != nil {
 		return fmt.Errorf("failed to get high quality stream URL: %w", err)
 	}
 
-	err = ffmpeg.Input(streamURL).
-		Output(tempGifPath, ffmpeg.KwArgs{
-			"vf":                "scale=486:-1:flags=lanczos,split[s0][s1];[s0]palettegen[p];[s1][p]paletteuse",
-			"loop":              "0", // Loop infinitely
-			"threads":           "8",
-			"preset":            "fast",
+	// ffmpeg only gets to fetch from the proxy, which checks every URL and
+	// redirect on its behalf
+	proxy, err := startMediaProxy(ctx, sourceClient(endpointAnimated), urlPolicyFor(endpointAnimated), sourceDialer, streamURL)
+	if err != nil {
+		return fmt.Errorf("rejected variant playlist: %w", err)
+	}
+	defer proxy.Close()
+	reportProgress(ctx, 10)
+
+	input := ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{params.inputArgs(), {"protocol_whitelist": "http,tcp,crypto"}})
+	tc := transcoder()
+	err = tc.Transcode(ctx, TranscodeRequest{
+		Input:     proxy.URL(),
+		InputArgs: input,
+		Output:    tempPath,
+		OutputArgs: ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{preset.outputArgs(format), params.outputArgs(format), {
+			"vf":                params.ffmpegFilters(preset, format),
+			"threads":           strconv.Itoa(currentConfig().Animated.Threads),
 			"multiple_requests": "1",
 			"buffer_size":       "8192k",
 			"loglevel":          "panic", // Only log errors
-		}).
-		GlobalArgs("-hide_banner").
-		OverWriteOutput().
-		ErrorToStdOut().
-		Run()
+		}}),
+		Format: format,
+		Width:  params.Width,
+	})
 
 	if err != nil {
 		logger.Errorf("FFmpeg error: %v", err)
 		return fmt.Errorf("ffmpeg command failed: %w", err)
 	}
+	reportProgress(ctx, 90)
 
-	if fi, err := os.Stat(tempGifPath); err != nil || fi.Size() == 0 {
-		logger.Errorf("Temporary file %s was not created or is empty", tempGifPath)
+	fi, err := os.Stat(tempPath)
+	if err != nil || fi.Size() == 0 {
+		logger.Errorf("Temporary file %s was not created or is empty", tempPath)
 		return fmt.Errorf("ffmpeg failed to create output file")
 	}
 
-	if err := os.Rename(tempGifPath, gifPath); err != nil {
-		logger.Errorf("Error renaming file: %v", err)
-		return fmt.Errorf("error renaming file: %w", err)
+	if err := format.check(tempPath); err != nil {
+		return err
 	}
 
-	return nil
-}
-
-func generateArtwork(c *gin.Context) {
-	urlStr := c.Query("url")
-	if urlStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "URL query parameter is required"})
-		return
+	// Make sure it decodes and came out as asked before anyone is served it
+	media, err := tc.Probe(ctx, tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to probe output: %w", err)
 	}
-
-	if err := isValidAppleURL(urlStr); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	media.Bytes = fi.Size()
+	if err := format.checkMedia(media, params); err != nil {
+		return fmt.Errorf("invalid output: %w", err)
 	}
 
-	key := generateKey(urlStr)
-	gifPath := filepath.Join(animatedArt, fmt.Sprintf("%s.gif", key))
+	if err := os.Rename(tempPath, format.path(key)); err != nil {
+		logger.Errorf("Error renaming file: %v", err)
+		return fmt.Errorf("error renaming file: %w", err)
+	}
 
-	if _, err := os.Stat(gifPath); err == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"key":     key,
-			"message": "GIF already exists",
-			"url":     fmt.Sprintf("%s/artwork/%s.gif", configURI, key),
-		})
-		return
+	err = updateArtworkMetadata(key, func(meta *artworkMetadata) {
+		now := time.Now()
+		meta.URL, meta.Preset, meta.Format, meta.Params, meta.CreatedAt = urlStr, params.Preset, params.Format, params, now
+		meta.Renditions[format.ext] = renditionMetadata{Preset: params.Preset, Format: params.Format, MediaInfo: media, CreatedAt: now}
+	})
+	if err != nil {
+		logger.Errorf("Failed to write metadata for %s: %v", key, err)
 	}
 
-	resultChan := make(chan error)
+	return nil
+}
 
-	go func() {
-		err := generateArtworkAsync(urlStr, key, gifPath)
-		resultChan <- err
-	}()
+// generateAnimatedArtwork returns the handler for an endpoint that produces
+// artwork in one of formats, the first being its default.
+func generateAnimatedArtwork(formats ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		urlStr := c.Query("url")
+		if urlStr == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "URL query parameter is required"})
+			return
+		}
 
-	select {
-	case err := <-resultChan:
+		if err := checkSourceURL(endpointAnimated, urlStr); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		params, err := parseAnimatedParams(c, formats...)
 		if err != nil {
-			logger.Errorf("Failed to generate artwork: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate artwork"})
-		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		format := lookupFormat(params.Format)
+
+		key := animatedKey(urlStr, params)
+
+		if _, err := os.Stat(format.path(key)); err == nil {
 			c.JSON(http.StatusOK, gin.H{
 				"key":     key,
-				"message": "GIF has been generated",
-				"url":     fmt.Sprintf("%s/artwork/%s.gif", configURI, key),
+				"message": fmt.Sprintf("%s already exists", format.label),
+				"params":  params,
+				"url":     format.url(key),
 			})
+			return
+		}
+
+		id := newJobID()
+		jobID, done, err := jobs.submit(id, format.taskType, key, format.name, GenerateArtworkPayload{URL: urlStr, Key: key, Params: params, JobID: id})
+		if err != nil {
+			logger.Errorf("Failed to queue artwork: %v", err)
+			c.JSON(queueErrorStatus(err), gin.H{"error": "Failed to queue artwork"})
+			return
+		}
+
+		select {
+		case job := <-done:
+			if job.State == JobFailed {
+				logger.Errorf("Failed to generate artwork: %s", job.Error)
+				respondJobFailed(c, job, "Failed to generate artwork")
+			} else {
+				c.JSON(http.StatusOK, gin.H{
+					"key":     key,
+					"job_id":  jobID,
+					"message": fmt.Sprintf("%s has been generated", format.label),
+					"params":  params,
+					"url":     job.ResultURL,
+				})
+			}
+		case <-c.Request.Context().Done():
+			// Client went away, the job keeps running for whoever asks next
+			return
+		case <-time.After(currentConfig().RequestTimeout):
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s generation timed out", format.label), "job_id": jobID})
 		}
-	case <-time.After(30 * time.Second):
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "GIF generation timed out"})
 	}
 }
 
@@ -239,7 +233,12 @@ func generateArtwork(c *gin.Context) {
 
 func generateArtistSquare(c *gin.Context) {
 	var request struct {
-		ImageURLs []string `json:"imageUrls" binding:"required,min=2,max=4"`
+		ImageURLs []string `json:"imageUrls" binding:"required,min=1,max=9"`
+		Layout    string   `json:"layout"`
+		Size      int      `json:"size"`
+		Format    string   `json:"format"`
+		Quality   int      `json:"quality"`
+		OnMissing string   `json:"onMissing"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -247,126 +246,160 @@ func generateArtistSquare(c *gin.Context) {
 		return
 	}
 
+	cfg := currentConfig().ArtistSquare
+	opts := ArtistSquareOptions{Layout: request.Layout, Size: request.Size, Format: request.Format, Quality: request.Quality, OnMissing: request.OnMissing}.withDefaults(cfg.Layout, cfg.OnMissing)
+	if _, ok := artistSquareLayouts[opts.Layout]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("layout must be one of %s", strings.Join(layoutNames(), ", "))})
+		return
+	}
+	if opts.Size != cfg.Size && !slices.Contains(cfg.AllowedSizes, opts.Size) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be one of %v", append([]int{cfg.Size}, cfg.AllowedSizes...))})
+		return
+	}
+	format := lookupSquareFormat(opts.Format)
+	if format == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("format must be one of %s", strings.Join(squareFormatNames(), ", "))})
+		return
+	}
+	// Checked as requested, withDefaults drops it for formats without one
+	if request.Quality < 0 || request.Quality > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quality must be between 0 and 100, 0 uses the format's default"})
+		return
+	}
+	if !slices.Contains(missingPolicies, opts.OnMissing) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("onMissing must be one of %s", strings.Join(missingPolicies, ", "))})
+		return
+	}
+
 	for _, url := range request.ImageURLs {
-		if err := isValidAppleURL(url); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid URL: %s. %s", url, err.Error())})
+		if err := checkSourceURL(endpointArtistSquare, url); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 	}
 
-	key := generateArtistSquareKey(request.ImageURLs)
-	squarePath := filepath.Join(artistSquares, fmt.Sprintf("%s.jpg", key))
+	key := artistSquareKey(request.ImageURLs, opts)
 
-	if _, err := os.Stat(squarePath); err == nil {
-		c.JSON(http.StatusOK, gin.H{
+	if reusableArtistSquare(key, format) {
+		c.JSON(http.StatusOK, withSubstituted(key, gin.H{
 			"key":     key,
 			"message": "Artist square already exists",
-			"url":     fmt.Sprintf("%s/artwork/artist-square/%s.jpg", configURI, key),
-		})
+			"url":     format.url(key),
+		}))
 		return
 	}
 
-	// Create a channel to receive the result
-	resultChan := make(chan error)
-
-	// Start a goroutine to generate the artist square
-	go func() {
-		err := generateArtistSquareAsync(request.ImageURLs, key)
-		resultChan <- err
-	}()
+	// Queue the job and wait for a worker to pick it up and finish it
+	id := newJobID()
+	jobID, done, err := jobs.submit(id, TypeCreateArtistSquare, key, "", CreateArtistSquarePayload{ImageURLs: request.ImageURLs, Options: opts, Key: key, JobID: id})
+	if err != nil {
+		logger.Errorf("Failed to queue artist square: %v", err)
+		c.JSON(queueErrorStatus(err), gin.H{"error": "Failed to queue artist square"})
+		return
+	}
 
-	// Wait for the goroutine to complete or timeout
+	// Wait for the job to complete or timeout
 	select {
-	case err := <-resultChan:
-		if err != nil {
-			logger.Errorf("Failed to generate artist square: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate artist square"})
+	case job := <-done:
+		if job.State == JobFailed {
+			logger.Errorf("Failed to generate artist square: %s", job.Error)
+			respondJobFailed(c, job, "Failed to generate artist square")
 		} else {
-			c.JSON(http.StatusOK, gin.H{
+			c.JSON(http.StatusOK, withSubstituted(key, gin.H{
 				"key":     key,
+				"job_id":  jobID,
 				"message": "Artist square has been generated",
-				"url":     fmt.Sprintf("%s/artwork/artist-square/%s.jpg", configURI, key),
-			})
+				"url":     job.ResultURL,
+			}))
 		}
-	case <-time.After(30 * time.Second): // Adjust timeout as needed
+	case <-c.Request.Context().Done():
+		// Client went away, the job keeps running for whoever asks next
+		return
+	case <-time.After(currentConfig().RequestTimeout): // Adjust timeout as needed
 		c.JSON(http.StatusAccepted, gin.H{
 			"key":     key,
+			"job_id":  jobID,
 			"message": "Artist square is still being processed. Please check back later.",
-			"url":     fmt.Sprintf("%s/artwork/artist-square/%s.jpg", configURI, key),
+			"url":     format.url(key),
 		})
 	}
 }
 
-func generateArtistSquareAsync(imageURLs []string, key string) error {
-	images, err := downloadImages(imageURLs)
+// withSubstituted adds the tiles of the artist square with key that aren't the
+// requested image to response, if there are any.
+func withSubstituted(key string, response gin.H) gin.H {
+	if meta, err := readArtistSquareMetadata(key); err == nil && len(meta.Substituted) > 0 {
+		response["substituted"] = meta.Substituted
+	}
+	return response
+}
+
+// reusableArtistSquare reports whether the artist square with key exists in
+// format and can be served as it is. A square made with missing images is
+// made again once it is older than ARTIST_SQUARE.MISSING_MAX_AGE, the images
+// may be back by then.
+func reusableArtistSquare(key string, format *squareFormat) bool {
+	if _, err := os.Stat(format.path(key)); err != nil {
+		return false
+	}
+	// Squares from before there was metadata had every image
+	meta, err := readArtistSquareMetadata(key)
+	if err != nil || len(meta.Substituted) == 0 {
+		return true
+	}
+	return time.Since(meta.CreatedAt) < currentConfig().ArtistSquare.MissingMaxAge
+}
+
+func generateArtistSquareAsync(ctx context.Context, imageURLs []string, opts ArtistSquareOptions, key string) error {
+	images, err := downloadImages(ctx, endpointArtistSquare, imageURLs)
+	var substituted []substitutedTile
 	if err != nil {
-		logger.Errorf("Failed to download images: %v", err)
-		return fmt.Errorf("failed to download images: %w", err)
+		for i, img := range images {
+			if img == nil {
+				substituted = append(substituted, substitutedTile{Index: i, URL: imageURLs[i]})
+			}
+		}
+		if opts.OnMissing == "strict" || len(substituted) == len(images) {
+			logger.Errorf("Failed to download images: %v", err)
+			return fmt.Errorf("failed to download images: %w", err)
+		}
+		logger.Warnf("Artist square %s is missing %d of %d images (%s): %v", key, len(substituted), len(images), opts.OnMissing, err)
+
+		var tiles []string
+		for _, tile := range substituted {
+			tiles = append(tiles, strconv.Itoa(tile.Index))
+		}
+		reportDetail(ctx, "substituted", strings.Join(tiles, ","))
 	}
+	reportProgress(ctx, 50)
 
-	square, err := createArtistSquare(images)
+	// Skipped images are left out of the layout, placeholders stay nil
+	if opts.OnMissing == "skip" {
+		images = slices.DeleteFunc(images, func(img image.Image) bool { return img == nil })
+	}
+
+	square, err := createArtistSquare(images, opts.Layout, opts.Size)
 	if err != nil {
 		logger.Errorf("Failed to create artist square: %v", err)
 		return fmt.Errorf("failed to create artist square: %w", err)
 	}
 
-	squarePath := filepath.Join(artistSquares, fmt.Sprintf("%s.jpg", key))
-
-	if err := saveImage(square, squarePath, "jpg"); err != nil {
+	if err := saveArtistSquare(ctx, square, key, opts); err != nil {
 		logger.Errorf("Failed to save artist square: %v", err)
 		return fmt.Errorf("failed to save artist square: %w", err)
 	}
 
-	return nil
-}
-
-func createArtistSquare(images []image.Image) (image.Image, error) {
-	size := 500
-	background := image.NewRGBA(image.Rect(0, 0, size, size))
-
-	resizeAndDraw := func(img image.Image, rect image.Rectangle) {
-		// Calculate aspect ratio
-		srcAspect := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
-		dstAspect := float64(rect.Dx()) / float64(rect.Dy())
-
-		var resizedImg image.Image
-		if srcAspect > dstAspect {
-			// Image is wider, resize based on height
-			newHeight := uint(rect.Dy())
-			newWidth := uint(float64(newHeight) * srcAspect)
-			resizedImg = resize.Resize(newWidth, newHeight, img, resize.Lanczos3)
-		} else {
-			// Image is taller, resize based on width
-			newWidth := uint(rect.Dx())
-			newHeight := uint(float64(newWidth) / srcAspect)
-			resizedImg = resize.Resize(newWidth, newHeight, img, resize.Lanczos3)
+	meta := artistSquareMetadata{ImageURLs: imageURLs, Options: opts, Substituted: substituted, CreatedAt: time.Now()}
+	if err := writeArtistSquareMetadata(key, meta); err != nil {
+		logger.Errorf("Failed to write metadata for artist square %s: %v", key, err)
+		// Without it the square would pass for complete and be kept for good
+		if len(substituted) > 0 {
+			os.Remove(lookupSquareFormat(opts.Format).path(key))
+			return fmt.Errorf("failed to write metadata: %w", err)
 		}
+	}
 
-		// Calculate positioning to center the image
-		srcBounds := resizedImg.Bounds()
-		dx := (srcBounds.Dx() - rect.Dx()) / 2
-		dy := (srcBounds.Dy() - rect.Dy()) / 2
-		draw.Draw(background, rect, resizedImg, image.Point{dx, dy}, draw.Src)
-	}
-
-	switch len(images) {
-	case 2:
-		resizeAndDraw(images[0], image.Rect(0, 0, size/2, size))
-		resizeAndDraw(images[1], image.Rect(size/2, 0, size, size))
-	case 3:
-		resizeAndDraw(images[0], image.Rect(0, 0, size, size/2))
-		resizeAndDraw(images[1], image.Rect(0, size/2, size/2, size))
-		resizeAndDraw(images[2], image.Rect(size/2, size/2, size, size))
-	case 4:
-		resizeAndDraw(images[0], image.Rect(0, 0, size/2, size/2))
-		resizeAndDraw(images[1], image.Rect(size/2, 0, size, size/2))
-		resizeAndDraw(images[2], image.Rect(0, size/2, size/2, size))
-		resizeAndDraw(images[3], image.Rect(size/2, size/2, size, size))
-	default:
-		return nil, fmt.Errorf("unsupported number of images: %d", len(images))
-	}
-
-	return background, nil
+	return nil
 }
 
 /*
@@ -385,7 +418,7 @@ func generateICloudArt(c *gin.Context) {
 		return
 	}
 
-	if err := isValidAppleURL(request.ImageURL); err != nil {
+	if err := checkSourceURL(endpointICloud, request.ImageURL); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -393,74 +426,59 @@ func generateICloudArt(c *gin.Context) {
 	key := generateKey(request.ImageURL)
 
 	// Check if the image already exists in any of the supported formats
-	formats := []string{"jpg", "jpeg", "png", "gif"}
-	var existingPath string
-	for _, format := range formats {
-		testPath := filepath.Join(icloudArt, fmt.Sprintf("%s.%s", key, format))
-		if _, err := os.Stat(testPath); err == nil {
-			existingPath = testPath
-			break
-		}
-	}
-
-	if existingPath != "" {
+	if existingPath := findICloudArt(key); existingPath != "" {
 		// Image already exists, return its information
 		c.JSON(http.StatusOK, gin.H{
 			"key":     key,
 			"message": "iCloud art already exists",
-			"url":     fmt.Sprintf("%s/artwork/icloud/%s%s", configURI, key, filepath.Ext(existingPath)),
+			"url":     fmt.Sprintf("%s/artwork/icloud/%s", currentConfig().PublishedURI, filepath.Base(existingPath)),
 		})
 		return
 	}
 
 	// Image doesn't exist, generate it
-	resultChan := make(chan error)
-
-	go func() {
-		err := generateICloudArtAsync(request.ImageURL, key)
-		resultChan <- err
-	}()
+	id := newJobID()
+	jobID, done, err := jobs.submit(id, TypeCreateICloudArt, key, "", CreateICloudArtPayload{ImageURL: request.ImageURL, Key: key, JobID: id})
+	if err != nil {
+		logger.Errorf("Failed to queue iCloud art: %v", err)
+		c.JSON(queueErrorStatus(err), gin.H{"error": "Failed to queue iCloud art"})
+		return
+	}
 
 	select {
-	case err := <-resultChan:
-		if err != nil {
-			logger.Errorf("Failed to generate iCloud art: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate iCloud art"})
+	case job := <-done:
+		if job.State == JobFailed {
+			logger.Errorf("Failed to generate iCloud art: %s", job.Error)
+			respondJobFailed(c, job, "Failed to generate iCloud art")
 		} else {
-			// Find the generated file and its format
-			var generatedPath string
-			for _, format := range formats {
-				testPath := filepath.Join(icloudArt, fmt.Sprintf("%s.%s", key, format))
-				if _, err := os.Stat(testPath); err == nil {
-					generatedPath = testPath
-					break
-				}
-			}
-
-			if generatedPath == "" {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to locate generated iCloud art"})
-			} else {
-				c.JSON(http.StatusOK, gin.H{
-					"key":     key,
-					"message": "iCloud art has been generated",
-					"url":     fmt.Sprintf("%s/artwork/icloud/%s%s", configURI, key, filepath.Ext(existingPath)),
-				})
-			}
+			c.JSON(http.StatusOK, gin.H{
+				"key":     key,
+				"job_id":  jobID,
+				"message": "iCloud art has been generated",
+				"url":     job.ResultURL,
+			})
 		}
-	case <-time.After(30 * time.Second): // Adjust timeout as needed
+	case <-c.Request.Context().Done():
+		// Client went away, the job keeps running for whoever asks next
+		return
+	case <-time.After(currentConfig().RequestTimeout): // Adjust timeout as needed
+		// The extension isn't known until the source image has been downloaded,
+		// the final URL is available from the job status once it has finished.
 		c.JSON(http.StatusAccepted, gin.H{
 			"key":     key,
+			"job_id":  jobID,
 			"message": "iCloud art is still being processed. Please check back later.",
-			"url":     fmt.Sprintf("%s/artwork/icloud/%s%s", configURI, key, filepath.Ext(existingPath)),
+			"status":  fmt.Sprintf("%s/jobs/%s", currentConfig().PublishedURI, jobID),
 		})
 	}
 }
 
-func generateICloudArtAsync(imageURL, key string) error {
-	img, format, err := downloadImage(imageURL)
+func generateICloudArtAsync(ctx context.Context, imageURL, key string) error {
+	img, format, err := downloadImage(ctx, endpointICloud, imageURL)
 	if err != nil {
 		return fmt.Errorf("failed to download image: %w", err)
 	}
+	reportProgress(ctx, 50)
 
 	iCloudImg, err := createICloudArt(img)
 	if err != nil {
@@ -470,7 +488,7 @@ func generateICloudArtAsync(imageURL, key string) error {
 	// Use the original format for the file extension
 	iCloudPath := filepath.Join(icloudArt, fmt.Sprintf("%s.%s", key, format))
 
-	if err := saveImage(iCloudImg, iCloudPath, format); err != nil {
+	if err := saveImage(iCloudImg, iCloudPath, format, currentConfig().ICloud.JPEGQuality); err != nil {
 		return fmt.Errorf("failed to save iCloud art: %w", err)
 	}
 
@@ -478,6 +496,6 @@ func generateICloudArtAsync(imageURL, key string) error {
 }
 
 func createICloudArt(img image.Image) (image.Image, error) {
-	size := 1024
+	size := currentConfig().ICloud.Size
 	return resize.Resize(uint(size), uint(size), img, resize.Lanczos3), nil
 }
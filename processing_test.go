@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testMasterPlaylist offers a stream too narrow for the default
+// ANIMATED.VARIANT.MIN_WIDTH, the one that should be picked for the default
+// width, and a wider one.
+const testMasterPlaylist = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-STREAM-INF:BANDWIDTH=400000,CODECS="avc1.64001f",RESOLUTION=400x400,VIDEO-RANGE=SDR
+v400/playlist.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=900000,CODECS="avc1.640028",RESOLUTION=640x640,VIDEO-RANGE=SDR
+v640/playlist.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,CODECS="avc1.640032",RESOLUTION=1080x1080,VIDEO-RANGE=SDR
+v1080/playlist.m3u8
+`
+
+const testMediaPlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:6.0,
+seg0.m4s
+#EXTINF:4.0,
+seg1.m4s
+#EXT-X-ENDLIST
+`
+
+// playlistServer serves a master playlist at /master.m3u8 and media
+// playlists for its streams, and remembers which paths were fetched.
+type playlistServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	fetched []string
+	// missing paths respond 404
+	missing map[string]bool
+	// oversized playlists are padded past maxPlaylistBytes
+	oversized map[string]bool
+}
+
+func newPlaylistServer(t *testing.T) *playlistServer {
+	t.Helper()
+	srv := &playlistServer{missing: make(map[string]bool), oversized: make(map[string]bool)}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		srv.fetched = append(srv.fetched, r.URL.Path)
+		missing, oversized := srv.missing[r.URL.Path], srv.oversized[r.URL.Path]
+		srv.mu.Unlock()
+		if oversized {
+			defer w.Write([]byte(strings.Repeat("#\n", maxPlaylistBytes/2)))
+		}
+		switch {
+		case missing:
+			http.NotFound(w, r)
+		case r.URL.Path == "/master.m3u8":
+			w.Write([]byte(testMasterPlaylist))
+		case strings.HasSuffix(r.URL.Path, "/playlist.m3u8"):
+			w.Write([]byte(testMediaPlaylist))
+		default:
+			w.Write([]byte("segment"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (s *playlistServer) wasFetched(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fetched := range s.fetched {
+		if fetched == path {
+			return true
+		}
+	}
+	return false
+}
+
+// setupAnimatedTest points the config and the animated artwork directory at
+// a fresh state that allows fetching from srv, and encodes with tc.
+func setupAnimatedTest(t *testing.T, srv *playlistServer, tc Transcoder) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Animated.Presets = make(map[string]PresetConfig)
+	for name, preset := range defaultPresets {
+		cfg.Animated.Presets[name] = preset
+	}
+	cfg.URLPolicy = URLPolicyConfig{Schemes: []string{"http"}, Hosts: []string{"127.0.0.1"}, Ports: []int{serverPort(t, srv.Server)}}
+	cfg.Outbound.AllowedNetworks = []string{"127.0.0.1/32"}
+	liveConfig.Store(cfg)
+
+	saved := animatedArt
+	animatedArt = t.TempDir()
+	t.Cleanup(func() { animatedArt = saved })
+	useTranscoder(t, tc)
+}
+
+func TestGenerateAnimatedArtwork(t *testing.T) {
+	srv := newPlaylistServer(t)
+	tc := &fakeTranscoder{}
+	setupAnimatedTest(t, srv, tc)
+
+	params := defaultAnimatedParams("gif", defaultPresets["gif"])
+	urlStr := srv.URL + "/master.m3u8"
+	key := animatedKey(urlStr, params)
+	if err := generateAnimatedArtworkAsync(context.Background(), urlStr, key, params); err != nil {
+		t.Fatal(err)
+	}
+
+	if !srv.wasFetched("/v640/playlist.m3u8") || srv.wasFetched("/v400/playlist.m3u8") || srv.wasFetched("/v1080/playlist.m3u8") {
+		t.Errorf("fetched %v, want only the 640 pixel stream", srv.fetched)
+	}
+	// ffmpeg only ever sees the proxy
+	if tc.playlist == "" || strings.Contains(tc.playlist, srv.URL) || !strings.Contains(tc.playlist, "/seg0.m4s\n") {
+		t.Errorf("ffmpeg got playlist:\n%s", tc.playlist)
+	}
+
+	format := lookupFormat("gif")
+	if _, err := os.Stat(format.path(key)); err != nil {
+		t.Errorf("output wasn't stored: %v", err)
+	}
+	if temps, _ := filepath.Glob(filepath.Join(animatedArt, "*_temp.*")); len(temps) > 0 {
+		t.Errorf("temporary files left behind: %v", temps)
+	}
+	meta, err := readArtworkMetadata(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendition := meta.Renditions["gif"]
+	if meta.URL != urlStr || rendition.Preset != "gif" || rendition.Width != params.Width || rendition.Bytes == 0 {
+		t.Errorf("metadata = %+v", meta)
+	}
+}
+
+func TestGenerateAnimatedArtworkFailures(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		missing string
+		tc      *fakeTranscoder
+		want    string
+		// oversized is a playlist padded past the size limit
+		oversized string
+	}{
+		{name: "master playlist missing", missing: "/master.m3u8", tc: &fakeTranscoder{}, want: "failed to fetch master playlist: 404"},
+		{name: "master playlist too large", oversized: "/master.m3u8", tc: &fakeTranscoder{}, want: "failed to fetch master playlist: playlist is larger than"},
+		{name: "media playlist too large", oversized: "/v640/playlist.m3u8", tc: &fakeTranscoder{}, want: "playlist is larger than"},
+		{name: "media playlist missing", missing: "/v640/playlist.m3u8", tc: &fakeTranscoder{}, want: "rejected variant playlist"},
+		{name: "transcode fails", tc: &fakeTranscoder{err: errors.New("encoder crashed")}, want: "encoder crashed"},
+		{name: "empty output", tc: &fakeTranscoder{output: []byte{}}, want: "failed to create output file"},
+		{name: "wrong format", tc: &fakeTranscoder{output: []byte("\x89PNG\r\n\x1a\n")}, want: `produced "png" instead of gif`},
+		{name: "wrong size", tc: &fakeTranscoder{info: &MediaInfo{Width: 100, Height: 100, Frames: 1}}, want: "invalid output"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newPlaylistServer(t)
+			if tt.missing != "" {
+				srv.missing[tt.missing] = true
+			}
+			if tt.oversized != "" {
+				srv.oversized[tt.oversized] = true
+			}
+			setupAnimatedTest(t, srv, tt.tc)
+
+			params := defaultAnimatedParams("gif", defaultPresets["gif"])
+			urlStr := srv.URL + "/master.m3u8"
+			key := animatedKey(urlStr, params)
+			err := generateAnimatedArtworkAsync(context.Background(), urlStr, key, params)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.want)
+			}
+
+			// Nothing is left behind, not even the temporary file
+			entries, _ := os.ReadDir(animatedArt)
+			for _, entry := range entries {
+				t.Errorf("%s left behind", entry.Name())
+			}
+		})
+	}
+}
+
+// setupArtistSquareJobTest serves a PNG at /<n>.png for every n and 404s
+// anything else, and points the artist square directory at a fresh one.
+func setupArtistSquareJobTest(t *testing.T, tc Transcoder) *httptest.Server {
+	t.Helper()
+	var tile bytes.Buffer
+	if err := png.Encode(&tile, image.NewRGBA(image.Rect(0, 0, 20, 20))); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(tile.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := defaultConfig()
+	cfg.URLPolicy = URLPolicyConfig{Schemes: []string{"http"}, Hosts: []string{"127.0.0.1"}, Ports: []int{serverPort(t, srv)}}
+	cfg.Outbound.AllowedNetworks = []string{"127.0.0.1/32"}
+	cfg.Fetch.Cache = false
+	liveConfig.Store(cfg)
+
+	saved := artistSquares
+	artistSquares = t.TempDir()
+	t.Cleanup(func() { artistSquares = saved })
+	useTranscoder(t, tc)
+	return srv
+}
+
+func TestArtistSquareMetadata(t *testing.T) {
+	srv := setupArtistSquareJobTest(t, &fakeTranscoder{})
+	urls := []string{srv.URL + "/0.png", srv.URL + "/missing.png"}
+	opts := ArtistSquareOptions{OnMissing: "placeholder"}.withDefaults("grid", "strict")
+	key := artistSquareKey(urls, opts)
+
+	if err := generateArtistSquareAsync(context.Background(), urls, opts, key); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := readArtistSquareMetadata(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Substituted) != 1 || meta.Substituted[0].Index != 1 {
+		t.Errorf("substituted = %+v, want tile 1", meta.Substituted)
+	}
+
+	// A square that can't be saved leaves no metadata behind
+	useTranscoder(t, &fakeTranscoder{err: errors.New("encoder crashed")})
+	opts.Format = "webp"
+	key = artistSquareKey(urls, opts)
+	if err := generateArtistSquareAsync(context.Background(), urls, opts, key); err == nil {
+		t.Fatal("saving with a failing encoder succeeded")
+	}
+	if _, err := readArtistSquareMetadata(key); !os.IsNotExist(err) {
+		t.Errorf("metadata of a square that wasn't saved: %v", err)
+	}
+}
+
+func TestReusableArtistSquare(t *testing.T) {
+	setupArtistSquareJobTest(t, &fakeTranscoder{})
+	currentConfig().ArtistSquare.MissingMaxAge = time.Hour
+	format := lookupSquareFormat("jpeg")
+	substituted := []substitutedTile{{Index: 1, URL: "https://is1-ssl.mzstatic.com/b.jpg"}}
+
+	for _, tt := range []struct {
+		name string
+		// meta is written next to the square unless nil
+		meta *artistSquareMetadata
+		want bool
+	}{
+		{name: "from before metadata", want: true},
+		{name: "complete", meta: &artistSquareMetadata{CreatedAt: time.Now().Add(-24 * time.Hour)}, want: true},
+		{name: "recent with missing images", meta: &artistSquareMetadata{Substituted: substituted, CreatedAt: time.Now().Add(-time.Minute)}, want: true},
+		{name: "old with missing images", meta: &artistSquareMetadata{Substituted: substituted, CreatedAt: time.Now().Add(-2 * time.Hour)}, want: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key := strings.ReplaceAll(tt.name, " ", "-")
+			if reusableArtistSquare(key, format) {
+				t.Fatal("a square that doesn't exist is reusable")
+			}
+			if err := os.WriteFile(format.path(key), []byte("square"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.meta != nil {
+				if err := writeArtistSquareMetadata(key, *tt.meta); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := reusableArtistSquare(key, format); got != tt.want {
+				t.Errorf("reusable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 0 never reuses them
+	currentConfig().ArtistSquare.MissingMaxAge = 0
+	if reusableArtistSquare("recent-with-missing-images", format) {
+		t.Error("reused with MISSING_MAX_AGE 0")
+	}
+}
+
+func TestGenerateArtistSquareQuality(t *testing.T) {
+	srv := setupArtistSquareJobTest(t, &fakeTranscoder{})
+	useJobs(t, map[string]jobHandler{
+		TypeCreateArtistSquare: func(ctx context.Context, job *Job) error {
+			job.ResultURL = "done"
+			return nil
+		},
+	})
+
+	for _, tt := range []struct {
+		format  string
+		quality int
+		want    int
+	}{
+		{"jpeg", -1, http.StatusBadRequest},
+		{"jpeg", 0, http.StatusOK},
+		{"jpeg", 1, http.StatusOK},
+		{"jpeg", 100, http.StatusOK},
+		{"jpeg", 101, http.StatusBadRequest},
+		// PNG has no quality, but nonsense is still refused
+		{"png", 0, http.StatusOK},
+		{"png", 101, http.StatusBadRequest},
+	} {
+		body := fmt.Sprintf(`{"imageUrls": [%q], "format": %q, "quality": %d}`, srv.URL+"/0.png", tt.format, tt.quality)
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/artwork/artist-square", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		generateArtistSquare(c)
+		if w.Code != tt.want {
+			t.Errorf("%s quality %d: status %d, want %d: %s", tt.format, tt.quality, w.Code, tt.want, w.Body)
+		}
+		if w.Code == http.StatusBadRequest && !strings.Contains(w.Body.String(), "quality must be between 0 and 100") {
+			t.Errorf("%s quality %d: %s", tt.format, tt.quality, w.Body)
+		}
+	}
+}
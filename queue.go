@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// JobQueue stores jobs and hands them out to workers. Backends other than
+// memory keep jobs across restarts: anything queued or running when the
+// process stopped is handed out again once the queue is reopened.
+type JobQueue interface {
+	// Enqueue stores a new job and makes it available to workers of its type.
+	Enqueue(job *Job) error
+	// Dequeue blocks until a job of the given type is available or ctx is done.
+	Dequeue(ctx context.Context, taskType string) (*Job, error)
+	// Update stores the current state of a job that has been dequeued.
+	Update(job *Job) error
+	// Get returns a copy of the stored job, or ErrJobNotFound.
+	Get(id string) (*Job, error)
+	Close() error
+}
+
+func openJobQueue(config QueueConfig) (JobQueue, error) {
+	switch config.Backend {
+	case "memory":
+		return newMemoryQueue(), nil
+	case "disk":
+		return openDiskQueue(config.Dir)
+	case "redis":
+		return openRedisQueue(config.RedisAddr)
+	default:
+		return nil, fmt.Errorf("unknown queue backend: %s", config.Backend)
+	}
+}
+
+// readyList is a set of FIFO lists of job IDs, one per task type, that
+// consumers can block on.
+type readyList struct {
+	mu     sync.Mutex
+	items  map[string][]string
+	signal map[string]chan struct{}
+}
+
+func newReadyList() *readyList {
+	return &readyList{
+		items:  make(map[string][]string),
+		signal: make(map[string]chan struct{}),
+	}
+}
+
+func (l *readyList) push(taskType, id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.items[taskType] = append(l.items[taskType], id)
+	if ch, ok := l.signal[taskType]; ok {
+		close(ch)
+		delete(l.signal, taskType)
+	}
+}
+
+func (l *readyList) pop(ctx context.Context, taskType string) (string, error) {
+	for {
+		l.mu.Lock()
+		if ids := l.items[taskType]; len(ids) > 0 {
+			l.items[taskType] = ids[1:]
+			l.mu.Unlock()
+			return ids[0], nil
+		}
+		ch, ok := l.signal[taskType]
+		if !ok {
+			ch = make(chan struct{})
+			l.signal[taskType] = ch
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+/*
+ * In-memory queue, jobs are lost on restart.
+ */
+
+type memoryQueue struct {
+	mu    sync.Mutex
+	jobs  map[string]Job
+	ready *readyList
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{
+		jobs:  make(map[string]Job),
+		ready: newReadyList(),
+	}
+}
+
+func (q *memoryQueue) Enqueue(job *Job) error {
+	q.mu.Lock()
+	q.jobs[job.ID] = *job
+	q.mu.Unlock()
+
+	q.ready.push(job.Type, job.ID)
+	return nil
+}
+
+func (q *memoryQueue) Dequeue(ctx context.Context, taskType string) (*Job, error) {
+	id, err := q.ready.pop(ctx, taskType)
+	if err != nil {
+		return nil, err
+	}
+	return q.Get(id)
+}
+
+func (q *memoryQueue) Update(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.jobs[job.ID] = *job
+	return nil
+}
+
+func (q *memoryQueue) Get(id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return &job, nil
+}
+
+func (q *memoryQueue) Prune(before time.Time) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := 0
+	for id, job := range q.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(before) {
+			delete(q.jobs, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (q *memoryQueue) Close() error {
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * On-disk queue, one JSON file per job.
+ *
+ * The files are the source of truth, the in-memory index only exists so that
+ * Get and Dequeue don't have to touch the filesystem.
+ */
+
+type diskQueue struct {
+	dir   string
+	mu    sync.Mutex
+	jobs  map[string]Job
+	ready *readyList
+}
+
+func openDiskQueue(dir string) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	q := &diskQueue{
+		dir:   dir,
+		jobs:  make(map[string]Job),
+		ready: newReadyList(),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	var pending []Job
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json.tmp") {
+			// Left behind by a write that never completed
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			logger.Errorf("Error reading job file %s: %v", entry.Name(), err)
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			logger.Errorf("Error parsing job file %s: %v", entry.Name(), err)
+			continue
+		}
+		q.jobs[job.ID] = job
+		if job.State == JobQueued || job.State == JobRunning {
+			pending = append(pending, job)
+		}
+	}
+
+	// Hand out interrupted jobs again, oldest first
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+	for _, job := range pending {
+		job.State = JobQueued
+		if err := q.Update(&job); err != nil {
+			return nil, err
+		}
+		q.ready.push(job.Type, job.ID)
+	}
+	if len(pending) > 0 {
+		logger.Infof("Recovered %d unfinished jobs from %s", len(pending), dir)
+	}
+
+	return q, nil
+}
+
+func (q *diskQueue) Enqueue(job *Job) error {
+	if err := q.Update(job); err != nil {
+		return err
+	}
+	q.ready.push(job.Type, job.ID)
+	return nil
+}
+
+func (q *diskQueue) Dequeue(ctx context.Context, taskType string) (*Job, error) {
+	id, err := q.ready.pop(ctx, taskType)
+	if err != nil {
+		return nil, err
+	}
+	return q.Get(id)
+}
+
+func (q *diskQueue) Update(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job: %w", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Write to a temp file first so a crash never leaves a truncated job behind
+	jobPath := filepath.Join(q.dir, fmt.Sprintf("%s.json", job.ID))
+	tempPath := filepath.Join(q.dir, fmt.Sprintf("%s.json.tmp", job.ID))
+	if err := os.WriteFile(tempPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write job file: %w", err)
+	}
+	if err := os.Rename(tempPath, jobPath); err != nil {
+		return fmt.Errorf("failed to write job file: %w", err)
+	}
+
+	q.jobs[job.ID] = *job
+	return nil
+}
+
+func (q *diskQueue) Get(id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return &job, nil
+}
+
+func (q *diskQueue) Prune(before time.Time) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := 0
+	for id, job := range q.jobs {
+		if job.FinishedAt == nil || !job.FinishedAt.Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(q.dir, fmt.Sprintf("%s.json", id))); err != nil && !os.IsNotExist(err) {
+			return count, fmt.Errorf("failed to remove job file: %w", err)
+		}
+		delete(q.jobs, id)
+		count++
+	}
+	return count, nil
+}
+
+func (q *diskQueue) Close() error {
+	return nil
+}
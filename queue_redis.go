@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * Redis queue, speaks plain RESP so it works against Redis, Valkey, KeyDB or
+ * any other server implementing the handful of commands used here.
+ *
+ * aniart:job:<id>                         JSON encoded job
+ * aniart:queue:<type>                     list of job IDs waiting for a worker
+ * aniart:processing:<type>:<instance>     list of job IDs an instance is working on
+ * aniart:instance:<instance>              heartbeat, expires unless the instance renews it
+ * aniart:instance:<instance>:types        set of task types the instance has dequeued
+ * aniart:instances                        set of instances that may own processing lists
+ *
+ * Every process that opens the queue is an instance with its own processing
+ * lists. Their jobs only go back on the queue when the instance closes the
+ * queue, or when its heartbeat has expired and another instance recovers
+ * them, so instances sharing a server never take each other's running jobs.
+ */
+
+const (
+	redisKeyPrefix   = "aniart:"
+	redisPopTimeout  = 1 // seconds, how long a blocking pop waits before checking ctx
+	redisDialTimeout = 5 * time.Second
+	// redisLease is how long an instance's jobs stay its own without a
+	// heartbeat, it is renewed three times as often
+	redisLease = 30 * time.Second
+)
+
+var errRedisNil = errors.New("redis: nil")
+
+type redisQueue struct {
+	addr     string
+	instance string
+	conns    chan *redisConn
+	// types are the task types this instance has dequeued
+	types sync.Map
+	// recovered are the task types whose processing list from before lists
+	// were kept per instance has been put back on the queue
+	recovered sync.Map
+	stop      chan struct{}
+	stopped   chan struct{}
+	stopOnce  sync.Once
+}
+
+func openRedisQueue(addr string) (*redisQueue, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("redis queue backend requires QUEUE.REDIS_ADDR")
+	}
+
+	q := &redisQueue{
+		addr:     addr,
+		instance: newJobID(),
+		conns:    make(chan *redisConn, 16),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	// Fail fast if the server is unreachable
+	if _, err := q.do("PING"); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", addr, err)
+	}
+	if err := q.heartbeat(); err != nil {
+		return nil, fmt.Errorf("failed to register with redis at %s: %w", addr, err)
+	}
+	logger.Infof("Redis queue instance: %s", q.instance)
+
+	go q.keepAlive()
+	return q, nil
+}
+
+func (q *redisQueue) queueKey(taskType string) string {
+	return redisKeyPrefix + "queue:" + taskType
+}
+
+func (q *redisQueue) processingKey(taskType, instance string) string {
+	return redisKeyPrefix + "processing:" + taskType + ":" + instance
+}
+
+func (q *redisQueue) instanceKey(instance string) string {
+	return redisKeyPrefix + "instance:" + instance
+}
+
+// heartbeat renews this instance's lease.
+func (q *redisQueue) heartbeat() error {
+	if _, err := q.do("SET", q.instanceKey(q.instance), "1", "EX", strconv.Itoa(int(redisLease.Seconds()))); err != nil {
+		return err
+	}
+	// Again every time, in case it was taken for dead while unreachable
+	_, err := q.do("SADD", redisKeyPrefix+"instances", q.instance)
+	return err
+}
+
+// keepAlive renews the lease and recovers the jobs of instances whose lease
+// has expired until the queue is closed.
+func (q *redisQueue) keepAlive() {
+	defer close(q.stopped)
+	ticker := time.NewTicker(redisLease / 3)
+	defer ticker.Stop()
+	for {
+		if err := q.recoverAbandoned(); err != nil {
+			logger.Errorf("Failed to recover jobs of stopped instances: %v", err)
+		}
+		select {
+		case <-ticker.C:
+			if err := q.heartbeat(); err != nil {
+				logger.Errorf("Failed to renew redis queue lease: %v", err)
+			}
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// recoverAbandoned puts the jobs of instances whose lease has expired back on
+// the queue and forgets about those instances.
+func (q *redisQueue) recoverAbandoned() error {
+	reply, err := q.do("SMEMBERS", redisKeyPrefix+"instances")
+	if err != nil {
+		return err
+	}
+	members, _ := reply.([]interface{})
+	for _, member := range members {
+		instance, _ := member.(string)
+		if instance == "" || instance == q.instance {
+			continue
+		}
+		alive, err := q.do("EXISTS", q.instanceKey(instance))
+		if err != nil {
+			return err
+		}
+		if n, _ := alive.(int64); n > 0 {
+			continue
+		}
+
+		reply, err := q.do("SMEMBERS", q.instanceKey(instance)+":types")
+		if err != nil {
+			return err
+		}
+		types, _ := reply.([]interface{})
+		recovered := 0
+		for _, t := range types {
+			taskType, _ := t.(string)
+			n, err := q.requeue(q.processingKey(taskType, instance), taskType)
+			recovered += n
+			if err != nil {
+				return err
+			}
+		}
+		if recovered > 0 {
+			logger.Warnf("Recovered %d jobs from stopped redis queue instance %s", recovered, instance)
+		}
+		if _, err := q.do("DEL", q.instanceKey(instance)+":types"); err != nil {
+			return err
+		}
+		if _, err := q.do("SREM", redisKeyPrefix+"instances", instance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requeue moves every job in the list at key back on the queue of taskType,
+// one at a time so none is lost if this is interrupted. It returns how many
+// were moved.
+func (q *redisQueue) requeue(key, taskType string) (int, error) {
+	for n := 0; ; n++ {
+		if _, err := q.do("RPOPLPUSH", key, q.queueKey(taskType)); err != nil {
+			if errors.Is(err, errRedisNil) {
+				return n, nil
+			}
+			return n, err
+		}
+	}
+}
+
+func (q *redisQueue) Enqueue(job *Job) error {
+	if err := q.Update(job); err != nil {
+		return err
+	}
+	_, err := q.do("LPUSH", q.queueKey(job.Type), job.ID)
+	return err
+}
+
+func (q *redisQueue) Dequeue(ctx context.Context, taskType string) (*Job, error) {
+	queueKey := q.queueKey(taskType)
+	processingKey := q.processingKey(taskType, q.instance)
+
+	// Registered before anything is in the list, so whoever recovers this
+	// instance's jobs knows where to look
+	if _, ok := q.types.Load(taskType); !ok {
+		if _, err := q.do("SADD", q.instanceKey(q.instance)+":types", taskType); err != nil {
+			return nil, err
+		}
+		q.types.Store(taskType, true)
+	}
+
+	// The single processing list of versions that didn't keep one per
+	// instance belonged to a previous run, put it back on the queue the
+	// first time this type is consumed.
+	if _, done := q.recovered.LoadOrStore(taskType, true); !done {
+		if _, err := q.requeue(redisKeyPrefix+"processing:"+taskType, taskType); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		reply, err := q.do("BRPOPLPUSH", queueKey, processingKey, strconv.Itoa(redisPopTimeout))
+		if errors.Is(err, errRedisNil) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		id, _ := reply.(string)
+		job, err := q.Get(id)
+		if errors.Is(err, ErrJobNotFound) {
+			logger.Errorf("Dropping unknown job %s from %s", id, queueKey)
+			q.do("LREM", processingKey, "0", id)
+			continue
+		}
+		return job, err
+	}
+}
+
+func (q *redisQueue) Update(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job: %w", err)
+	}
+	if job.State != JobSucceeded && job.State != JobFailed {
+		_, err := q.do("SET", redisKeyPrefix+"job:"+job.ID, string(data))
+		return err
+	}
+
+	// Finished jobs expire by themselves instead of being pruned
+	expiry := strconv.Itoa(int(jobRetention.Seconds()))
+	if _, err := q.do("SET", redisKeyPrefix+"job:"+job.ID, string(data), "EX", expiry); err != nil {
+		return err
+	}
+	if _, err := q.do("LREM", q.processingKey(job.Type, q.instance), "0", job.ID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (q *redisQueue) Get(id string) (*Job, error) {
+	reply, err := q.do("GET", redisKeyPrefix+"job:"+id)
+	if errors.Is(err, errRedisNil) {
+		return nil, ErrJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, _ := reply.(string)
+	var job Job
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return nil, fmt.Errorf("failed to decode job %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// Close hands the jobs this instance still holds, the ones killed by
+// shutdown, back to the queue for other instances or the next start, and
+// gives up the lease.
+func (q *redisQueue) Close() error {
+	q.stopKeepAlive()
+
+	var errs []error
+	q.types.Range(func(key, _ any) bool {
+		taskType := key.(string)
+		if _, err := q.requeue(q.processingKey(taskType, q.instance), taskType); err != nil {
+			errs = append(errs, err)
+		}
+		return true
+	})
+	if len(errs) == 0 {
+		for _, args := range [][]string{
+			{"SREM", redisKeyPrefix + "instances", q.instance},
+			{"DEL", q.instanceKey(q.instance), q.instanceKey(q.instance) + ":types"},
+		} {
+			if _, err := q.do(args...); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for {
+		select {
+		case conn := <-q.conns:
+			conn.Close()
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// stopKeepAlive stops renewing the lease and waits for keepAlive to return.
+func (q *redisQueue) stopKeepAlive() {
+	q.stopOnce.Do(func() { close(q.stop) })
+	<-q.stopped
+}
+
+// do runs a single command on a pooled connection. Connections that hit an
+// I/O error are discarded rather than returned to the pool.
+func (q *redisQueue) do(args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-q.conns:
+	default:
+		c, err := net.DialTimeout("tcp", q.addr, redisDialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("redis dial failed: %w", err)
+		}
+		conn = &redisConn{Conn: c, reader: bufio.NewReader(c)}
+	}
+
+	reply, err := conn.do(args...)
+
+	var redisErr redisError
+	if err == nil || errors.Is(err, errRedisNil) || errors.As(err, &redisErr) {
+		select {
+		case q.conns <- conn:
+		default:
+			conn.Close()
+		}
+	} else {
+		conn.Close()
+	}
+
+	return reply, err
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	// Commands are sent as an array of bulk strings
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if size < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if count < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil && !errors.Is(err, errRedisNil) {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-memory stand-in for a Redis server, implementing just
+// the commands the redis queue uses. Expiry is not implemented, tests delete
+// heartbeats to let leases run out.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	lists   map[string][]string // head first
+	sets    map[string]map[string]bool
+	addr    string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	r := &fakeRedis{
+		strings: make(map[string]string),
+		lists:   make(map[string][]string),
+		sets:    make(map[string]map[string]bool),
+		addr:    ln.Addr().String(),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, r.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func (r *fakeRedis) reply(args []string) string {
+	if strings.ToUpper(args[0]) == "BRPOPLPUSH" {
+		// Blocks briefly rather than for the whole timeout
+		for i := 0; i < 10; i++ {
+			if reply := r.reply([]string{"RPOPLPUSH", args[1], args[2]}); reply != "$-1\r\n" {
+				return reply
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return "$-1\r\n"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "SET":
+		r.strings[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		value, ok := r.strings[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if r.exists(key) {
+				n++
+			}
+			delete(r.strings, key)
+			delete(r.lists, key)
+			delete(r.sets, key)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "EXISTS":
+		if r.exists(args[1]) {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SADD":
+		if r.sets[args[1]] == nil {
+			r.sets[args[1]] = make(map[string]bool)
+		}
+		r.sets[args[1]][args[2]] = true
+		return ":1\r\n"
+	case "SREM":
+		delete(r.sets[args[1]], args[2])
+		return ":1\r\n"
+	case "SMEMBERS":
+		var members []string
+		for member := range r.sets[args[1]] {
+			members = append(members, member)
+		}
+		reply := fmt.Sprintf("*%d\r\n", len(members))
+		for _, member := range members {
+			reply += bulk(member)
+		}
+		return reply
+	case "LPUSH":
+		r.lists[args[1]] = append([]string{args[2]}, r.lists[args[1]]...)
+		return fmt.Sprintf(":%d\r\n", len(r.lists[args[1]]))
+	case "RPOPLPUSH":
+		src := r.lists[args[1]]
+		if len(src) == 0 {
+			return "$-1\r\n"
+		}
+		value := src[len(src)-1]
+		r.lists[args[1]] = src[:len(src)-1]
+		r.lists[args[2]] = append([]string{value}, r.lists[args[2]]...)
+		return bulk(value)
+	case "LREM":
+		before := len(r.lists[args[1]])
+		r.lists[args[1]] = slices.DeleteFunc(r.lists[args[1]], func(v string) bool { return v == args[3] })
+		return fmt.Sprintf(":%d\r\n", before-len(r.lists[args[1]]))
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func (r *fakeRedis) exists(key string) bool {
+	_, isString := r.strings[key]
+	return isString || len(r.lists[key]) > 0 || len(r.sets[key]) > 0
+}
+
+func (r *fakeRedis) list(key string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.lists[key])
+}
+
+func (r *fakeRedis) del(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.strings, key)
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func openTestRedisQueue(t *testing.T, r *fakeRedis) *redisQueue {
+	t.Helper()
+	q, err := openRedisQueue(r.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func TestRedisQueue(t *testing.T) {
+	testQueueCycle(t, openTestRedisQueue(t, newFakeRedis(t)))
+}
+
+func TestRedisQueueKeepsRunningJobsToTheirInstance(t *testing.T) {
+	r := newFakeRedis(t)
+	a := openTestRedisQueue(t, r)
+	job := enqueueTestJob(t, a)
+	if got := dequeueSoon(t, a); got == nil || got.ID != job.ID {
+		t.Fatalf("dequeued %+v, want job %s", got, job.ID)
+	}
+
+	// An instance starting next to a, as another replica or after a
+	// restart, leaves a's running job alone
+	b := openTestRedisQueue(t, r)
+	if err := b.recoverAbandoned(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dequeueSoon(t, b); got != nil {
+		t.Fatalf("b took job %s while a is running it", got.ID)
+	}
+	if got := r.list(a.processingKey(job.Type, a.instance)); !slices.Equal(got, []string{job.ID}) {
+		t.Errorf("a's processing list = %v", got)
+	}
+
+	// Finishing it takes it off a's list
+	job.State = JobSucceeded
+	if err := a.Update(job); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.list(a.processingKey(job.Type, a.instance)); len(got) > 0 {
+		t.Errorf("a's processing list = %v after the job finished", got)
+	}
+}
+
+func TestRedisQueueRecoversJobsOfExpiredInstances(t *testing.T) {
+	r := newFakeRedis(t)
+	a := openTestRedisQueue(t, r)
+	job := enqueueTestJob(t, a)
+	if got := dequeueSoon(t, a); got == nil {
+		t.Fatal("nothing dequeued")
+	}
+
+	// a crashes: it stops renewing its lease, which then runs out
+	a.stopKeepAlive()
+	r.del(a.instanceKey(a.instance))
+
+	b := openTestRedisQueue(t, r)
+	if err := b.recoverAbandoned(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dequeueSoon(t, b); got == nil || got.ID != job.ID {
+		t.Fatalf("b dequeued %+v, want a's job %s", got, job.ID)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sets[redisKeyPrefix+"instances"][a.instance] || r.exists(a.instanceKey(a.instance)+":types") {
+		t.Error("expired instance is still registered")
+	}
+}
+
+func TestRedisQueueCloseRequeuesJobs(t *testing.T) {
+	r := newFakeRedis(t)
+	a := openTestRedisQueue(t, r)
+	job := enqueueTestJob(t, a)
+	if got := dequeueSoon(t, a); got == nil {
+		t.Fatal("nothing dequeued")
+	}
+
+	// Shutdown killed the job, it goes back on the queue with the instance
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.list(a.queueKey(job.Type)); !slices.Equal(got, []string{job.ID}) {
+		t.Errorf("queue = %v, want %s back on it", got, job.ID)
+	}
+	r.mu.Lock()
+	registered := r.sets[redisKeyPrefix+"instances"][a.instance] || r.exists(a.instanceKey(a.instance))
+	r.mu.Unlock()
+	if registered {
+		t.Error("closed instance is still registered")
+	}
+
+	b := openTestRedisQueue(t, r)
+	if got := dequeueSoon(t, b); got == nil || got.ID != job.ID {
+		t.Fatalf("b dequeued %+v, want %s", got, job.ID)
+	}
+}
+
+func TestRedisQueueRecoversLegacyProcessingList(t *testing.T) {
+	r := newFakeRedis(t)
+	q := openTestRedisQueue(t, r)
+	job := enqueueTestJob(t, q)
+
+	// Left running by a version with a single processing list
+	r.mu.Lock()
+	r.lists[q.queueKey(job.Type)] = nil
+	r.lists[redisKeyPrefix+"processing:"+job.Type] = []string{job.ID}
+	r.mu.Unlock()
+
+	if got := dequeueSoon(t, q); got == nil || got.ID != job.ID {
+		t.Fatalf("dequeued %+v, want %s", got, job.ID)
+	}
+}
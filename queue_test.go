@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func enqueueTestJob(t *testing.T, q JobQueue) *Job {
+	t.Helper()
+	return enqueueTestJobOf(t, q, TypeGenerateAltArtwork, time.Now())
+}
+
+func enqueueTestJobOf(t *testing.T, q JobQueue, taskType string, created time.Time) *Job {
+	t.Helper()
+	job := &Job{ID: newJobID(), Type: taskType, State: JobQueued, CreatedAt: created}
+	if err := q.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// dequeueSoon dequeues a job, or returns nil if none comes within a second.
+func dequeueSoon(t *testing.T, q JobQueue) *Job {
+	t.Helper()
+	return dequeueSoonOf(t, q, TypeGenerateAltArtwork)
+}
+
+func dequeueSoonOf(t *testing.T, q JobQueue, taskType string) *Job {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	job, err := q.Dequeue(ctx, taskType)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// testQueueCycle runs jobs through q the way the job manager does: enqueue,
+// dequeue, run and finish.
+func testQueueCycle(t *testing.T, q JobQueue) {
+	first := enqueueTestJob(t, q)
+	second := enqueueTestJob(t, q)
+	other := enqueueTestJobOf(t, q, TypeCreateArtistSquare, time.Now())
+
+	// First in, first out, per task type
+	for _, want := range []*Job{first, second} {
+		if got := dequeueSoon(t, q); got == nil || got.ID != want.ID {
+			t.Fatalf("dequeued %+v, want %s", got, want.ID)
+		}
+	}
+	if got := dequeueSoon(t, q); got != nil {
+		t.Fatalf("dequeued %s from an empty queue", got.ID)
+	}
+	if got := dequeueSoonOf(t, q, TypeCreateArtistSquare); got == nil || got.ID != other.ID {
+		t.Fatalf("dequeued %+v, want %s", got, other.ID)
+	}
+
+	first.State = JobRunning
+	first.Progress = 50
+	if err := q.Update(first); err != nil {
+		t.Fatal(err)
+	}
+	// Get hands out copies
+	got, err := q.Get(first.ID)
+	if err != nil || got.State != JobRunning || got.Progress != 50 {
+		t.Fatalf("Get = %+v, %v", got, err)
+	}
+	got.Progress = 90
+	if again, _ := q.Get(first.ID); again.Progress != 50 {
+		t.Error("changing what Get returned changed the stored job")
+	}
+
+	finished := time.Now()
+	first.State, first.Progress, first.ResultURL, first.FinishedAt = JobSucceeded, 100, "done", &finished
+	if err := q.Update(first); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := q.Get(first.ID); err != nil || got.State != JobSucceeded || got.ResultURL != "done" {
+		t.Errorf("finished job = %+v, %v", got, err)
+	}
+	if _, err := q.Get("unknown"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Get of an unknown job: %v", err)
+	}
+
+	if pruner, ok := q.(jobPruner); ok {
+		if n, err := pruner.Prune(finished); err != nil || n != 0 {
+			t.Errorf("pruned %d jobs finished at the cut-off, %v", n, err)
+		}
+		if n, err := pruner.Prune(finished.Add(time.Second)); err != nil || n != 1 {
+			t.Errorf("pruned %d jobs, want 1, %v", n, err)
+		}
+		if _, err := q.Get(first.ID); !errors.Is(err, ErrJobNotFound) {
+			t.Errorf("pruned job is still there: %v", err)
+		}
+		if _, err := q.Get(second.ID); err != nil {
+			t.Errorf("unfinished job was pruned: %v", err)
+		}
+	}
+}
+
+func TestMemoryQueue(t *testing.T) {
+	testQueueCycle(t, newMemoryQueue())
+}
+
+func TestDiskQueue(t *testing.T) {
+	q, err := openDiskQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testQueueCycle(t, q)
+}
+
+func TestDiskQueueRecoversUnfinishedJobs(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	running := enqueueTestJobOf(t, q, TypeGenerateAltArtwork, start.Add(time.Minute))
+	queued := enqueueTestJobOf(t, q, TypeGenerateAltArtwork, start.Add(2*time.Minute))
+	older := enqueueTestJobOf(t, q, TypeGenerateAltArtwork, start)
+	failed := enqueueTestJobOf(t, q, TypeGenerateAltArtwork, start)
+	for range 3 {
+		if got := dequeueSoon(t, q); got == nil {
+			t.Fatal("nothing dequeued")
+		}
+	}
+	running.State = JobRunning
+	running.Attempts = 1
+	failed.State = JobFailed
+	for _, job := range []*Job{running, failed} {
+		if err := q.Update(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// older was dequeued but the process stopped before it was marked
+	// running, it's still queued on disk
+
+	// Left behind by a crash in the middle of a write, and by who knows what
+	os.WriteFile(filepath.Join(dir, "partial.json.tmp"), []byte(`{"id": "part`), 0644)
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"id": `), 0644)
+
+	q, err = openDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Oldest first, whatever order they were queued in
+	for _, want := range []*Job{older, running, queued} {
+		got := dequeueSoon(t, q)
+		if got == nil || got.ID != want.ID {
+			t.Fatalf("dequeued %+v, want %s", got, want.ID)
+		}
+		if got.State != JobQueued {
+			t.Errorf("recovered job %s is %s, want queued", got.ID, got.State)
+		}
+		if got.ID == running.ID && got.Attempts != 1 {
+			t.Errorf("recovered job lost its attempts: %d", got.Attempts)
+		}
+	}
+	if got := dequeueSoon(t, q); got != nil {
+		t.Errorf("finished job %s was handed out again", got.ID)
+	}
+	if got, err := q.Get(failed.ID); err != nil || got.State != JobFailed {
+		t.Errorf("finished job = %+v, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial.json.tmp")); !os.IsNotExist(err) {
+		t.Error("partial write was left behind")
+	}
+}
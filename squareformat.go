@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+/*
+ * Artist square formats
+ *
+ * JPEG and PNG are encoded in Go. Go has no WebP or AVIF encoder, for those
+ * the square is written as a lossless PNG first and converted by the
+ * Transcoder, the same way animated artwork is encoded.
+ */
+
+// squareFormat is a format artist squares can be stored in.
+type squareFormat struct {
+	name        string
+	ext         string
+	contentType string
+	// defaultQuality is used when the request doesn't ask for one, nil for
+	// formats without a quality setting
+	defaultQuality func() int
+	// args returns the ffmpeg output options for quality, nil for formats
+	// encoded in Go
+	args func(quality int) ffmpeg.KwArgs
+}
+
+// squareFormats are the formats artist squares can be requested in. The
+// first one is the default.
+var squareFormats = []*squareFormat{
+	{
+		name: "jpeg", ext: "jpg", contentType: "image/jpeg",
+		defaultQuality: func() int { return currentConfig().ArtistSquare.JPEGQuality },
+	},
+	{
+		name: "png", ext: "png", contentType: "image/png",
+	},
+	{
+		name: "webp", ext: "webp", contentType: "image/webp",
+		defaultQuality: func() int { return 80 },
+		args: func(quality int) ffmpeg.KwArgs {
+			return ffmpeg.KwArgs{"c:v": "libwebp", "quality": strconv.Itoa(quality), "frames:v": "1"}
+		},
+	},
+	{
+		name: "avif", ext: "avif", contentType: "image/avif",
+		defaultQuality: func() int { return 60 },
+		args: func(quality int) ffmpeg.KwArgs {
+			// libaom's CRF goes from 0 (lossless) to 63
+			crf := (100 - quality) * 63 / 100
+			return ffmpeg.KwArgs{"c:v": "libaom-av1", "crf": strconv.Itoa(crf), "still-picture": "1",
+				"pix_fmt": "yuv420p", "f": "avif"}
+		},
+	},
+}
+
+// lookupSquareFormat returns the format called name, or nil if there is none.
+// jpg is accepted for jpeg.
+func lookupSquareFormat(name string) *squareFormat {
+	for _, f := range squareFormats {
+		if f.name == name || f.ext == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// squareFormatNames returns the names of all squareFormats.
+func squareFormatNames() []string {
+	names := make([]string, len(squareFormats))
+	for i, f := range squareFormats {
+		names[i] = f.name
+	}
+	return names
+}
+
+// path returns where the artist square with key is stored in the format.
+func (f *squareFormat) path(key string) string {
+	return filepath.Join(artistSquares, fmt.Sprintf("%s.%s", key, f.ext))
+}
+
+// url returns the published URL of the artist square with key in the format.
+func (f *squareFormat) url(key string) string {
+	return fmt.Sprintf("%s/artwork/artist-square/%s.%s", currentConfig().PublishedURI, key, f.ext)
+}
+
+// substitutedTile is an image of an artist square that couldn't be
+// downloaded, and was skipped or replaced by a placeholder.
+type substitutedTile struct {
+	// Index is the image's position in the request, from 0
+	Index int    `json:"index"`
+	URL   string `json:"url"`
+}
+
+// artistSquareMetadata is stored next to an artist square as <key>.json,
+// recording what it was made from.
+type artistSquareMetadata struct {
+	ImageURLs   []string            `json:"image_urls"`
+	Options     ArtistSquareOptions `json:"options"`
+	Substituted []substitutedTile   `json:"substituted,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+}
+
+// readArtistSquareMetadata reads the metadata stored for the artist square
+// with key. Squares from before there was metadata have none.
+func readArtistSquareMetadata(key string) (artistSquareMetadata, error) {
+	var meta artistSquareMetadata
+	data, err := os.ReadFile(filepath.Join(artistSquares, fmt.Sprintf("%s.json", key)))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// writeArtistSquareMetadata stores meta for the artist square with key.
+func writeArtistSquareMetadata(key string, meta artistSquareMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(artistSquares, fmt.Sprintf("%s_temp.json", key))
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(artistSquares, fmt.Sprintf("%s.json", key)))
+}
+
+// saveArtistSquare stores img as the artist square with key, as opts ask.
+func saveArtistSquare(ctx context.Context, img image.Image, key string, opts ArtistSquareOptions) error {
+	format := lookupSquareFormat(opts.Format)
+	if format == nil {
+		return fmt.Errorf("unknown format %q", opts.Format)
+	}
+
+	// Written next to the square and renamed over it, so it's never served
+	// half written
+	pngPath := filepath.Join(artistSquares, fmt.Sprintf("%s_temp.png", key))
+	tempPath := filepath.Join(artistSquares, fmt.Sprintf("%s_temp.%s", key, format.ext))
+	defer func() {
+		for _, path := range []string{pngPath, tempPath} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				logger.Errorf("Failed to remove temporary file %s: %v", path, err)
+			}
+		}
+	}()
+
+	if format.args == nil {
+		if err := saveImage(img, tempPath, format.name, opts.Quality); err != nil {
+			return err
+		}
+		return os.Rename(tempPath, format.path(key))
+	}
+
+	if err := saveImage(img, pngPath, "png", 0); err != nil {
+		return err
+	}
+
+	// The animated format of the same name describes the same kind of file
+	encoded := lookupFormat(format.name)
+	tc := transcoder()
+	err := tc.Transcode(ctx, TranscodeRequest{
+		Input:      pngPath,
+		InputArgs:  ffmpeg.KwArgs{},
+		Output:     tempPath,
+		OutputArgs: ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{format.args(opts.Quality), {"loglevel": "panic"}}),
+		Format:     encoded,
+		Width:      opts.Size,
+	})
+	if err != nil {
+		return fmt.Errorf("ffmpeg command failed: %w", err)
+	}
+
+	if err := encoded.check(tempPath); err != nil {
+		return err
+	}
+	media, err := tc.Probe(ctx, tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to probe output: %w", err)
+	}
+	if media.Width != opts.Size || media.Height != opts.Size {
+		return fmt.Errorf("output is %dx%d, expected %dx%d", media.Width, media.Height, opts.Size, opts.Size)
+	}
+
+	return os.Rename(tempPath, format.path(key))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveArtistSquare(t *testing.T) {
+	liveConfig.Store(defaultConfig())
+	useTranscoder(t, &fakeTranscoder{})
+	saved := artistSquares
+	artistSquares = t.TempDir()
+	t.Cleanup(func() { artistSquares = saved })
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for _, name := range []string{"jpeg", "png", "webp", "avif"} {
+		t.Run(name, func(t *testing.T) {
+			format := lookupSquareFormat(name)
+			key := "square-" + name
+			// Replacing an existing square works the same way
+			if err := os.WriteFile(format.path(key), []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := ArtistSquareOptions{Size: 64, Format: name, Quality: 90}
+			if err := saveArtistSquare(context.Background(), img, key, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(format.path(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) == "old" || len(data) == 0 {
+				t.Errorf("square wasn't replaced")
+			}
+			if temps, _ := filepath.Glob(filepath.Join(artistSquares, key+"_temp.*")); len(temps) > 0 {
+				t.Errorf("temporary files left behind: %v", temps)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+/*
+ * Transcoders
+ *
+ * The animated artwork pipeline hands the actual encoding, and probing what
+ * came out, to a Transcoder. In production that is always ffmpeg; tests
+ * substitute one that doesn't need it installed.
+ */
+
+// TranscodeRequest is one encoding of a stream into a file.
+type TranscodeRequest struct {
+	Input      string
+	InputArgs  ffmpeg.KwArgs
+	Output     string
+	OutputArgs ffmpeg.KwArgs
+	// Format is what Output is expected to contain
+	Format *outputFormat
+	// Width is what the output is scaled to, the filters in OutputArgs
+	// already take care of it
+	Width int
+}
+
+// MediaInfo is what probing a generated file found. Duration is in seconds.
+type MediaInfo struct {
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Frames   int     `json:"frames"`
+	Duration float64 `json:"duration"`
+	Bytes    int64   `json:"bytes"`
+}
+
+// Transcoder encodes the stream in a TranscodeRequest and probes the result.
+// Both must stop and return when ctx is done.
+type Transcoder interface {
+	Transcode(ctx context.Context, req TranscodeRequest) error
+	// Probe decodes the file at path and describes its video. Bytes is
+	// left to the caller.
+	Probe(ctx context.Context, path string) (MediaInfo, error)
+}
+
+// transcoder returns the Transcoder jobs encode with.
+var transcoder = func() Transcoder {
+	return ffmpegTranscoder{}
+}
+
+// ffmpegTranscoder runs the ffmpeg binary.
+type ffmpegTranscoder struct{}
+
+func (ffmpegTranscoder) Transcode(ctx context.Context, req TranscodeRequest) error {
+	stream := ffmpeg.Input(req.Input, req.InputArgs).
+		Output(req.Output, req.OutputArgs).
+		GlobalArgs("-hide_banner").
+		OverWriteOutput()
+
+	// Kill ffmpeg if ctx is done before it exits
+	cmd := exec.CommandContext(ctx, "ffmpeg", stream.GetArgs()...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stdout
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("ffmpeg aborted: %w", ctx.Err())
+		}
+		return err
+	}
+	return nil
+}
+
+// ffprobeOutput is the part of ffprobe's JSON output Probe asks for.
+type ffprobeOutput struct {
+	Streams []struct {
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		NbReadFrames string `json:"nb_read_frames"`
+		Duration     string `json:"duration"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+func (ffmpegTranscoder) Probe(ctx context.Context, path string) (MediaInfo, error) {
+	// count_frames decodes every frame, so a file that doesn't decode fails
+	// here rather than in the client
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-count_frames", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,nb_read_frames,duration:format=duration", "-of", "json", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return MediaInfo{}, fmt.Errorf("ffprobe aborted: %w", ctx.Err())
+		}
+		return MediaInfo{}, fmt.Errorf("ffprobe failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var probed ffprobeOutput
+	if err := json.Unmarshal(out, &probed); err != nil {
+		return MediaInfo{}, fmt.Errorf("invalid ffprobe output: %w", err)
+	}
+	if len(probed.Streams) == 0 {
+		return MediaInfo{}, fmt.Errorf("no video stream")
+	}
+	stream := probed.Streams[0]
+	info := MediaInfo{Width: stream.Width, Height: stream.Height}
+	// Either may be missing, depending on the format
+	info.Frames, _ = strconv.Atoi(stream.NbReadFrames)
+	if info.Duration, err = strconv.ParseFloat(stream.Duration, 64); err != nil {
+		info.Duration, _ = strconv.ParseFloat(probed.Format.Duration, 64)
+	}
+	return info, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTranscoder stands in for ffmpeg. It reads the playlist it is given the
+// way ffmpeg would and writes the smallest file detectAnimatedFormat
+// recognises as the requested format, or output if that is set.
+type fakeTranscoder struct {
+	// output replaces the placeholder, err fails the transcode and info
+	// replaces what probing finds
+	output []byte
+	err    error
+	info   *MediaInfo
+
+	mu       sync.Mutex
+	playlist string
+	written  map[string]MediaInfo
+}
+
+// useTranscoder makes jobs encode with tc until the test is over.
+func useTranscoder(t *testing.T, tc Transcoder) {
+	t.Helper()
+	saved := transcoder
+	transcoder = func() Transcoder { return tc }
+	t.Cleanup(func() { transcoder = saved })
+}
+
+func (t *fakeTranscoder) Transcode(ctx context.Context, req TranscodeRequest) error {
+	var playlist []byte
+	if strings.HasPrefix(req.Input, "http://") {
+		var err error
+		if playlist, err = fetchPlaylist(ctx, req.Input); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.playlist = string(playlist)
+	if t.err != nil {
+		return t.err
+	}
+
+	data := t.output
+	if data == nil {
+		var err error
+		if data, err = placeholderFile(req.Format.ext); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(req.Output, data, 0644); err != nil {
+		return err
+	}
+	if t.written == nil {
+		t.written = make(map[string]MediaInfo)
+	}
+	// A single square frame, like most artwork
+	t.written[req.Output] = MediaInfo{Width: req.Width, Height: req.Width, Frames: 1}
+	return nil
+}
+
+func (t *fakeTranscoder) Probe(ctx context.Context, path string) (MediaInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.written[path]
+	if !ok {
+		return MediaInfo{}, fmt.Errorf("%s wasn't written by the fake transcoder", path)
+	}
+	if t.info != nil {
+		return *t.info, nil
+	}
+	return info, nil
+}
+
+// fetchPlaylist reads the playlist at rawURL like ffmpeg, which doesn't go
+// through the outbound client.
+func fetchPlaylist(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", rawURL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// placeholderFile returns the signature of a file with extension ext.
+func placeholderFile(ext string) ([]byte, error) {
+	switch ext {
+	case "gif":
+		return []byte("GIF89a"), nil
+	case "webp":
+		return []byte("RIFF\x04\x00\x00\x00WEBP"), nil
+	case "avif":
+		return []byte("\x00\x00\x00\x10ftypavif\x00\x00\x00\x00"), nil
+	case "mp4":
+		return []byte("\x00\x00\x00\x10ftypisom\x00\x00\x00\x00"), nil
+	case "apng":
+		return append([]byte("\x89PNG\r\n\x1a\n"), pngChunk("acTL", make([]byte, 8))...), nil
+	}
+	return nil, fmt.Errorf("no placeholder for %s", ext)
+}
+
+// pngChunk encodes a PNG chunk: length, type, data and CRC.
+func pngChunk(typ string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
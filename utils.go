@@ -1,10 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"image/gif"
@@ -14,31 +15,81 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"sort"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
+
+	"aniart/m3u8"
 
-	"github.com/go-resty/resty/v2"
 	"golang.org/x/image/webp"
 )
 
 const (
-	TypeGenerateArtwork    = "artwork:generate"
-	TypeCreateArtistSquare = "artwork:create_artist_square"
-	TypeCreateICloudArt    = "artwork:create_icloud_art"
+	TypeGenerateArtwork      = "artwork:generate"
+	TypeGenerateAltArtwork   = "artwork:generate_alt"
+	TypeGenerateVideoArtwork = "artwork:generate_video"
+	TypeCreateArtistSquare   = "artwork:create_artist_square"
+	TypeCreateICloudArt      = "artwork:create_icloud_art"
 )
 
 type GenerateArtworkPayload struct {
-	URL   string `json:"url"`
-	Key   string `json:"key"`
-	JobID string `json:"job_id"`
+	URL    string         `json:"url"`
+	Key    string         `json:"key"`
+	Params AnimatedParams `json:"params"`
+	JobID  string         `json:"job_id"`
 }
 
 type CreateArtistSquarePayload struct {
-	ImageURLs []string `json:"image_urls"`
-	Key       string   `json:"key"`
-	JobID     string   `json:"job_id"`
+	ImageURLs []string            `json:"image_urls"`
+	Options   ArtistSquareOptions `json:"options"`
+	Key       string              `json:"key"`
+	JobID     string              `json:"job_id"`
+}
+
+// ArtistSquareOptions are the per-request options for artist squares. Jobs
+// queued before there were any have none.
+type ArtistSquareOptions struct {
+	Layout  string `json:"layout,omitempty"`
+	Size    int    `json:"size,omitempty"`
+	Format  string `json:"format,omitempty"`
+	Quality int    `json:"quality,omitempty"`
+	// OnMissing is what happens to tiles whose image can't be downloaded,
+	// one of missingPolicies
+	OnMissing string `json:"on_missing,omitempty"`
+}
+
+// missingPolicies are the values of ArtistSquareOptions.OnMissing: fail the
+// whole square, lay it out without the missing images, or fill their tiles
+// with ARTIST_SQUARE.PLACEHOLDER_COLOR.
+var missingPolicies = []string{"strict", "skip", "placeholder"}
+
+// withDefaults fills in the options that weren't given: the configured size
+// and JPEG, with the format's default quality. layout and onMissing are the
+// defaults for the others.
+func (o ArtistSquareOptions) withDefaults(layout, onMissing string) ArtistSquareOptions {
+	if o.Layout == "" {
+		o.Layout = layout
+	}
+	if o.OnMissing == "" {
+		o.OnMissing = onMissing
+	}
+	if o.Size == 0 {
+		o.Size = currentConfig().ArtistSquare.Size
+	}
+	if o.Format == "" {
+		o.Format = squareFormats[0].name
+	}
+	if f := lookupSquareFormat(o.Format); f != nil {
+		o.Format = f.name
+		if f.defaultQuality == nil {
+			o.Quality = 0
+		} else if o.Quality == 0 {
+			o.Quality = f.defaultQuality()
+		}
+	}
+	return o
 }
 
 type CreateICloudArtPayload struct {
@@ -47,32 +98,64 @@ type CreateICloudArtPayload struct {
 	JobID    string `json:"job_id"`
 }
 
-type streamInfo struct {
-	averageBandwidth int
-	bandwidth        int
-	codecs           string
-	frameRate        float64
-	resolution       struct {
-		width  int
-		height int
-	}
+// ImageTooLargeError is returned when a source image exceeds the DOWNLOAD
+// limits, either in bytes or in pixels.
+type ImageTooLargeError struct {
+	URL    string
+	Reason string
+}
+
+func (e *ImageTooLargeError) Error() string {
+	return fmt.Sprintf("image %s is too large: %s", e.URL, e.Reason)
 }
 
-func downloadImages(urls []string) ([]image.Image, error) {
-	var images []image.Image
-	var errors []string
+// UnsupportedMediaTypeError is returned when a source URL doesn't serve an
+// image in a format that can be decoded.
+type UnsupportedMediaTypeError struct {
+	URL         string
+	ContentType string
+}
 
-	for _, url := range urls {
-		img, _, err := downloadImage(url)
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("failed to download image from %s: %v", url, err))
-			continue
-		}
-		images = append(images, img)
+func (e *UnsupportedMediaTypeError) Error() string {
+	return fmt.Sprintf("%s is not a supported image, got %s", e.URL, e.ContentType)
+}
+
+// supportedImageTypes are the sniffed content types downloadImage can decode.
+var supportedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// downloadImages downloads the images at urls, up to FETCH.CONCURRENCY at a
+// time. They are returned in the order of urls; images that failed to
+// download are left nil, and the error describes each failure.
+func downloadImages(ctx context.Context, endpoint string, urls []string) ([]image.Image, error) {
+	images := make([]image.Image, len(urls))
+	errs := make([]error, len(urls))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, currentConfig().Fetch.Concurrency)
+	for i, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			img, _, err := downloadImage(ctx, endpoint, url)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to download image from %s: %w", url, err)
+				return
+			}
+			images[i] = img
+		}()
 	}
+	wg.Wait()
 
-	if len(errors) > 0 {
-		return images, fmt.Errorf("some images failed to download: %s", strings.Join(errors, "; "))
+	if err := errors.Join(errs...); err != nil {
+		return images, fmt.Errorf("some images failed to download: %w", err)
 	}
 
 	return images, nil
@@ -83,139 +166,132 @@ func generateKey(url string) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// generateArtistSquareKey returns the key for an artist square of imageUrls.
+// The order of the URLs is the order of the tiles, so it is part of the key,
+// and so are duplicates, each fills a tile. URLs are normalised first, see
+// normalizeURL. imageUrls is left as it is.
+//
+// Squares used to be made of 2 to 4 images, keyed and laid out with their
+// URLs sorted. 2 to 4 URLs in sorted order still get that key, since their
+// tiles are the same. Anything else could collide with it, the old key has no
+// separator between the URLs.
 func generateArtistSquareKey(imageUrls []string) string {
-	sort.Strings(imageUrls)
-	combinedUrls := strings.Join(imageUrls, "")
-	hash := md5.Sum([]byte(combinedUrls))
-	return hex.EncodeToString(hash[:])
+	normalized := make([]string, len(imageUrls))
+	for i, u := range imageUrls {
+		normalized[i] = normalizeURL(u)
+	}
+	if len(normalized) >= 2 && len(normalized) <= 4 && slices.IsSorted(normalized) {
+		return generateKey(strings.Join(normalized, ""))
+	}
+	// Newlines can't be part of a URL, unlike the empty separator
+	return generateKey("ordered\n" + strings.Join(normalized, "\n"))
 }
 
-func getHighQualityStreamURL(masterPlaylistURL string) (string, error) {
-	resp, err := http.Get(masterPlaylistURL)
+// normalizeURL returns rawURL with the parts that don't change what it points
+// to spelled one way: lowercase scheme and host, no default port and no
+// fragment. URLs that don't parse are returned as they are.
+func normalizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch master playlist: %w", err)
+		return rawURL
 	}
-	defer resp.Body.Close()
-
-	scanner := bufio.NewScanner(resp.Body)
-	var selectedStreamURL string
-	var maxWidth int
-	var streamURL string
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
-			info := parseStreamInfo(line)
-			if isValidStream(info) {
-				width := info.resolution.width
-				if width > maxWidth {
-					maxWidth = width
-					streamURL = ""
-				}
-			}
-		} else if strings.HasPrefix(line, "http") && streamURL == "" {
-			streamURL = line
-			if maxWidth > 0 {
-				selectedStreamURL = streamURL
-			}
-		}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); port != "" && port == strconv.Itoa(defaultPort(u.Scheme)) {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
 	}
-
-	if selectedStreamURL == "" {
-		return "", fmt.Errorf("no suitable stream found")
+	if u.Host != "" && u.Path == "" {
+		u.Path = "/"
 	}
-
-	return resolveURL(masterPlaylistURL, selectedStreamURL), nil
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
 }
 
-func parseStreamInfo(line string) streamInfo {
-	info := streamInfo{}
-	parts := strings.Split(line[18:], ",")
-	for _, part := range parts {
-		keyValue := strings.SplitN(part, "=", 2)
-		if len(keyValue) != 2 {
-			continue
-		}
-		key := strings.TrimSpace(keyValue[0])
-		value := strings.Trim(keyValue[1], "\"")
-		switch key {
-		case "AVERAGE-BANDWIDTH":
-			info.averageBandwidth, _ = strconv.Atoi(value)
-		case "BANDWIDTH":
-			info.bandwidth, _ = strconv.Atoi(value)
-		case "CODECS":
-			info.codecs = value
-		case "FRAME-RATE":
-			info.frameRate, _ = strconv.ParseFloat(value, 64)
-		case "RESOLUTION":
-			res := strings.Split(value, "x")
-			if len(res) == 2 {
-				info.resolution.width, _ = strconv.Atoi(res[0])
-				info.resolution.height, _ = strconv.Atoi(res[1])
-			}
-		}
+// artistSquareKey returns the cache key for an artist square. Squares with
+// the options they had before there were any keep their plain key.
+func artistSquareKey(imageUrls []string, opts ArtistSquareOptions) string {
+	key := generateArtistSquareKey(imageUrls)
+	if opts == (ArtistSquareOptions{}).withDefaults("grid", "strict") {
+		return key
+	}
+	variant := fmt.Sprintf("%s#layout=%s,size=%d,format=%s,q=%d", key, opts.Layout, opts.Size, opts.Format, opts.Quality)
+	// A square with substitutes isn't the same as one that failed instead
+	if opts.OnMissing != "strict" {
+		variant += ",missing=" + opts.OnMissing
 	}
-	return info
+	return generateKey(variant)
 }
 
-func isValidStream(info streamInfo) bool {
-	return strings.Contains(info.codecs, "hvc1") ||
-		strings.Contains(info.codecs, "avc1") &&
-			info.resolution.width >= 450
-}
+// getHighQualityStreamURL returns the URL of the variant in the master
+// playlist that artwork targetWidth pixels wide should be generated from.
+func getHighQualityStreamURL(ctx context.Context, masterPlaylistURL string, targetWidth int) (string, error) {
+	client := sourceClient(endpointAnimated)
 
-func resolveURL(base, relative string) string {
-	baseURL, err := url.Parse(base)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, masterPlaylistURL, nil)
 	if err != nil {
-		return relative
+		return "", fmt.Errorf("failed to fetch master playlist: %w", err)
 	}
-	relativeURL, err := url.Parse(relative)
+	resp, err := client.Do(req)
 	if err != nil {
-		return relative
+		return "", fmt.Errorf("failed to fetch master playlist: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch master playlist: %s", resp.Status)
 	}
-	return baseURL.ResolveReference(relativeURL).String()
-}
 
-func isValidAppleURL(urlStr string) error {
-	parsedURL, err := url.Parse(urlStr)
+	data, err := readPlaylist(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch master playlist: %w", err)
+	}
+	playlist, err := m3u8.ParseMaster(bytes.NewReader(data), resp.Request.URL)
 	if err != nil {
-		return fmt.Errorf("invalid URL")
+		return "", fmt.Errorf("failed to parse master playlist: %w", err)
 	}
 
-	hostname := parsedURL.Hostname()
-	if !strings.HasSuffix(hostname, ".apple.com") && !strings.HasSuffix(hostname, ".mzstatic.com") {
-		return fmt.Errorf("URL must be from *.apple.com or *.mzstatic.com domain")
+	selected, reason, err := variantSelector().Select(playlist.Variants, targetWidth)
+	if err != nil {
+		return "", err
 	}
+	logger.Debugf("Selected %s from %s: %s", selected.URI, masterPlaylistURL, reason)
+	reportDetail(ctx, "variant", reason)
 
-	return nil
+	return selected.URI, nil
 }
 
-func downloadImage(url string) (image.Image, string, error) {
-	client := resty.New().
-		SetRetryCount(3).
-		SetRetryWaitTime(1 * time.Second).
-		SetRetryMaxWaitTime(5 * time.Second).
-		SetTimeout(30 * time.Second)
-
-	resp, err := client.R().
-		SetDoNotParseResponse(true).
-		SetHeader("User-Agent", "AniArt/1.0").
-		Get(url)
-
+// downloadImage fetches and decodes the image at url, checking it against the
+// DOWNLOAD limits before decoding.
+func downloadImage(ctx context.Context, endpoint, url string) (image.Image, string, error) {
+	imgData, err := fetchSource(ctx, endpoint, url)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to download image: %w", err)
 	}
-	defer resp.RawBody().Close()
-
-	imgData, err := io.ReadAll(resp.RawBody())
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to read image data: %w", err)
-	}
 
 	if len(imgData) == 0 {
 		return nil, "", fmt.Errorf("downloaded image data is empty")
 	}
 
+	// Go by what the data is rather than what the server says it is, plenty
+	// of CDNs serve images as application/octet-stream
+	if contentType := http.DetectContentType(imgData); !supportedImageTypes[contentType] {
+		return nil, "", &UnsupportedMediaTypeError{URL: url, ContentType: contentType}
+	}
+
+	// Check the dimensions from the header before decoding, a small file can
+	// declare an image big enough to exhaust memory once decoded
+	limits := currentConfig().Download
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(imgData))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image header: %w", err)
+	}
+	if cfg.Width > limits.MaxDimension || cfg.Height > limits.MaxDimension {
+		return nil, "", &ImageTooLargeError{URL: url, Reason: fmt.Sprintf("%dx%d pixels, the limit is %d in either direction", cfg.Width, cfg.Height, limits.MaxDimension)}
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(limits.MaxPixels) {
+		return nil, "", &ImageTooLargeError{URL: url, Reason: fmt.Sprintf("%dx%d pixels, the limit is %d pixels", cfg.Width, cfg.Height, limits.MaxPixels)}
+	}
+
 	// Try to decode the image using image.Decode, which can handle multiple formats
 	img, format, err := image.Decode(bytes.NewReader(imgData))
 	if err != nil {
@@ -248,21 +324,38 @@ func downloadImage(url string) (image.Image, string, error) {
 	return img, format, nil
 }
 
-func saveImage(img image.Image, filePath, format string) error {
+// findICloudArt returns the path of the stored iCloud art for key in whichever
+// format it was saved in, or "" if there is none.
+func findICloudArt(key string) string {
+	formats := []string{"jpg", "jpeg", "png", "gif"}
+	for _, format := range formats {
+		testPath := filepath.Join(icloudArt, fmt.Sprintf("%s.%s", key, format))
+		if _, err := os.Stat(testPath); err == nil {
+			return testPath
+		}
+	}
+	return ""
+}
+
+func saveImage(img image.Image, filePath, format string, jpegQuality int) error {
 	file, err := os.Create(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
-	defer file.Close()
 
 	switch format {
 	case "jpeg", "jpg":
-		return jpeg.Encode(file, img, &jpeg.Options{Quality: 95})
+		err = jpeg.Encode(file, img, &jpeg.Options{Quality: jpegQuality})
 	case "png":
-		return png.Encode(file, img)
+		err = png.Encode(file, img)
 	case "gif":
-		return gif.Encode(file, img, &gif.Options{})
+		err = gif.Encode(file, img, &gif.Options{})
 	default:
-		return fmt.Errorf("unsupported image format: %s", format)
+		err = fmt.Errorf("unsupported image format: %s", format)
+	}
+	// A failed close can mean the data never made it to disk
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
 	}
+	return err
 }
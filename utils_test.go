@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGenerateArtistSquareKey(t *testing.T) {
+	const (
+		a = "https://is1-ssl.mzstatic.com/image/a.jpg"
+		b = "https://is1-ssl.mzstatic.com/image/b.jpg"
+		c = "https://is1-ssl.mzstatic.com/image/c.jpg"
+		d = "https://is1-ssl.mzstatic.com/image/d.jpg"
+		e = "https://is1-ssl.mzstatic.com/image/e.jpg"
+	)
+	// How squares were keyed before their URLs were kept in order
+	legacy := func(urls ...string) string {
+		hash := md5.Sum([]byte(strings.Join(urls, "")))
+		return hex.EncodeToString(hash[:])
+	}
+
+	for _, tt := range []struct {
+		name string
+		urls []string
+		// same lists URLs that must get the same key
+		same [][]string
+		// different lists URLs that must get another key
+		different [][]string
+		legacy    bool
+	}{
+		{
+			name:      "sorted pair keeps the old key",
+			urls:      []string{a, b},
+			different: [][]string{{b, a}},
+			legacy:    true,
+		},
+		{
+			name:   "sorted four keep the old key",
+			urls:   []string{a, b, c, d},
+			legacy: true,
+		},
+		{
+			name:      "order matters",
+			urls:      []string{c, a, b},
+			different: [][]string{{a, b, c}, {b, c, a}},
+		},
+		{
+			name:      "duplicates fill their own tiles",
+			urls:      []string{a, a, b},
+			different: [][]string{{a, b}, {a, b, b}},
+			legacy:    true,
+		},
+		{
+			name: "a single URL never gets the old key",
+			urls: []string{a},
+		},
+		{
+			name: "five sorted URLs never get the old key",
+			urls: []string{a, b, c, d, e},
+		},
+		{
+			name: "normalised before keying",
+			urls: []string{a, c},
+			same: [][]string{
+				{"HTTPS://IS1-SSL.MZSTATIC.COM/image/a.jpg", c},
+				{"https://is1-ssl.mzstatic.com:443/image/a.jpg", c + "#fragment"},
+			},
+			// Paths are case sensitive
+			different: [][]string{{"https://is1-ssl.mzstatic.com/IMAGE/a.jpg", c}},
+			legacy:    true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key := generateArtistSquareKey(tt.urls)
+			if isLegacy := key == legacy(tt.urls...); isLegacy != tt.legacy {
+				t.Errorf("legacy key = %v, want %v", isLegacy, tt.legacy)
+			}
+			for _, urls := range tt.same {
+				if got := generateArtistSquareKey(urls); got != key {
+					t.Errorf("%v got key %s, want the key of %v, %s", urls, got, tt.urls, key)
+				}
+			}
+			for _, urls := range tt.different {
+				if got := generateArtistSquareKey(urls); got == key {
+					t.Errorf("%v got the same key as %v", urls, tt.urls)
+				}
+			}
+		})
+	}
+
+	// The old key joins URLs without a separator, so only the lists it was
+	// used for may produce it
+	if generateArtistSquareKey([]string{a + b}) == generateArtistSquareKey([]string{a, b}) {
+		t.Error("a single URL collides with the pair it is the concatenation of")
+	}
+
+	urls := []string{c, a, b}
+	generateArtistSquareKey(urls)
+	if !slices.Equal(urls, []string{c, a, b}) {
+		t.Errorf("the URLs were reordered to %v", urls)
+	}
+}
+
+func TestDownloadImage(t *testing.T) {
+	// A header is enough to declare any size, the body never gets decoded
+	header := func(width, height uint32) []byte {
+		ihdr := binary.BigEndian.AppendUint32(nil, width)
+		ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+		ihdr = append(ihdr, 8, 6, 0, 0, 0)
+		return concat([]byte("\x89PNG\r\n\x1a\n"), pngChunk("IHDR", ihdr), pngChunk("IEND", nil))
+	}
+	var small bytes.Buffer
+	if err := png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 20, 10))); err != nil {
+		t.Fatal(err)
+	}
+	bodies := map[string][]byte{
+		"/small.png":     small.Bytes(),
+		"/wide.png":      header(100000, 1),
+		"/tall.png":      header(1, 100000),
+		"/area.png":      header(2000, 2000),
+		"/page.html":     []byte("<!DOCTYPE html><html><body>not an image</body></html>"),
+		"/text":          []byte("just some text"),
+		"/huge.png":      concat(small.Bytes(), make([]byte, 4096)),
+		"/streamed.png":  concat(small.Bytes(), make([]byte, 4096)),
+		"/truncated.png": small.Bytes()[:40],
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/streamed.png" {
+			// No Content-Length, the limit has to be found while reading
+			w.Write(body[:100])
+			w.(http.Flusher).Flush()
+			body = body[100:]
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	cfg := defaultConfig()
+	cfg.URLPolicy = URLPolicyConfig{Schemes: []string{"http"}, Hosts: []string{"127.0.0.1"}, Ports: []int{serverPort(t, srv)}}
+	cfg.Outbound.AllowedNetworks = []string{"127.0.0.1/32"}
+	cfg.Fetch.Cache = false
+	cfg.Download = DownloadConfig{MaxBytes: 2048, MaxDimension: 4000, MaxPixels: 1000000}
+	liveConfig.Store(cfg)
+
+	tooLarge := func(err error) bool {
+		var target *ImageTooLargeError
+		return errors.As(err, &target)
+	}
+	unsupported := func(err error) bool {
+		var target *UnsupportedMediaTypeError
+		return errors.As(err, &target)
+	}
+	for _, tt := range []struct {
+		path string
+		// check is what err must be, nil for none
+		check  func(error) bool
+		status int
+	}{
+		{path: "/small.png"},
+		{path: "/wide.png", check: tooLarge, status: http.StatusRequestEntityTooLarge},
+		{path: "/tall.png", check: tooLarge, status: http.StatusRequestEntityTooLarge},
+		{path: "/area.png", check: tooLarge, status: http.StatusRequestEntityTooLarge},
+		{path: "/huge.png", check: tooLarge, status: http.StatusRequestEntityTooLarge},
+		{path: "/streamed.png", check: tooLarge, status: http.StatusRequestEntityTooLarge},
+		{path: "/page.html", check: unsupported, status: http.StatusUnsupportedMediaType},
+		{path: "/text", check: unsupported, status: http.StatusUnsupportedMediaType},
+		// Broken images are our failure to report, not the client's
+		{path: "/truncated.png", check: func(err error) bool { return err != nil }},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			img, _, err := downloadImage(context.Background(), endpointArtistSquare, srv.URL+tt.path)
+			if tt.check == nil {
+				if err != nil || img == nil {
+					t.Fatalf("img = %v, err = %v", img, err)
+				}
+			} else if !tt.check(err) {
+				t.Fatalf("err = %v (%T)", err, err)
+			}
+
+			// The status survives the wrapping on the way out of a job
+			_, err = downloadImages(context.Background(), endpointArtistSquare, []string{srv.URL + tt.path})
+			if status := jobErrorStatus(err); status != tt.status {
+				t.Errorf("status %d, want %d for %v", status, tt.status, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"aniart/m3u8"
+)
+
+/*
+ * Variant selection
+ *
+ * Animated artwork is offered in several variants, differing in codec,
+ * resolution, bitrate and dynamic range. The one to generate from is picked
+ * by a VariantSelector, configured in ANIMATED.VARIANT.
+ */
+
+// ErrNoSuitableVariant is returned when none of a playlist's variants can be
+// used.
+var ErrNoSuitableVariant = errors.New("no suitable stream found")
+
+// VariantSelector picks the variant to generate artwork targetWidth pixels
+// wide from. Along with the variant it returns a short explanation of why it
+// was chosen.
+type VariantSelector interface {
+	Select(variants []m3u8.Variant, targetWidth int) (m3u8.Variant, string, error)
+}
+
+// variantSelector returns the selector for the current configuration.
+func variantSelector() VariantSelector {
+	return variantPolicy{currentConfig().Animated.Variant}
+}
+
+// videoCodec returns the codec family of the variant's video, "avc1" for
+// H.264 and "hvc1" for HEVC (including Dolby Vision), or "" if it has no
+// video we can decode.
+func videoCodec(v m3u8.Variant) string {
+	switch {
+	case v.HasCodec("avc1"), v.HasCodec("avc3"):
+		return "avc1"
+	case v.HasCodec("hvc1"), v.HasCodec("hev1"), v.HasCodec("dvh1"), v.HasCodec("dvhe"):
+		return "hvc1"
+	}
+	return ""
+}
+
+// isSDR reports whether the variant is SDR. Playlists that don't say are SDR,
+// as that's what VIDEO-RANGE defaults to.
+func isSDR(v m3u8.Variant) bool {
+	return v.VideoRange == "" || v.VideoRange == "SDR"
+}
+
+func describeVariant(v m3u8.Variant) string {
+	videoRange := v.VideoRange
+	if videoRange == "" {
+		videoRange = "SDR"
+	}
+	return fmt.Sprintf("%dx%d %s %s %dbps", v.Width, v.Height, videoCodec(v), videoRange, v.Bandwidth)
+}
+
+// variantPolicy narrows the variants down step by step: first to the usable
+// ones, then to the preferred range and codec if there are any, and finally
+// picks the one closest to the target width.
+type variantPolicy struct {
+	VariantConfig
+}
+
+func (p variantPolicy) Select(variants []m3u8.Variant, targetWidth int) (m3u8.Variant, string, error) {
+	var candidates []m3u8.Variant
+	rejected := make(map[string]int)
+	for _, v := range variants {
+		switch {
+		case videoCodec(v) == "":
+			rejected["unsupported codec"]++
+		case v.Width < p.MinWidth:
+			rejected[fmt.Sprintf("narrower than %dpx", p.MinWidth)]++
+		case p.MaxBandwidth > 0 && v.Bandwidth > p.MaxBandwidth:
+			rejected[fmt.Sprintf("over %dbps", p.MaxBandwidth)]++
+		default:
+			candidates = append(candidates, v)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return m3u8.Variant{}, "", fmt.Errorf("%w among %d variants (%s)", ErrNoSuitableVariant, len(variants), describeRejections(rejected))
+	}
+
+	reasons := []string{fmt.Sprintf("%d of %d variants usable", len(candidates), len(variants))}
+	if len(rejected) > 0 {
+		reasons[0] += fmt.Sprintf(" (%s)", describeRejections(rejected))
+	}
+
+	// Preferences only narrow the candidates down if something matches them
+	prefer := func(name string, match func(m3u8.Variant) bool) {
+		var matching []m3u8.Variant
+		for _, v := range candidates {
+			if match(v) {
+				matching = append(matching, v)
+			}
+		}
+		if len(matching) > 0 && len(matching) < len(candidates) {
+			candidates = matching
+			reasons = append(reasons, "preferred "+name)
+		}
+	}
+	if p.PreferSDR {
+		prefer("SDR", isSDR)
+	}
+	if p.PreferCodec != "" {
+		prefer(p.PreferCodec, func(v m3u8.Variant) bool { return videoCodec(v) == p.PreferCodec })
+	}
+
+	// The narrowest variant at least as wide as the target avoids upscaling
+	// without decoding more than needed. If they are all narrower, take the
+	// widest. Same widths go to the lower bandwidth.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Width != candidates[j].Width {
+			return candidates[i].Width < candidates[j].Width
+		}
+		return candidates[i].Bandwidth < candidates[j].Bandwidth
+	})
+	selected := candidates[len(candidates)-1]
+	for _, v := range candidates {
+		if v.Width >= targetWidth {
+			selected = v
+			break
+		}
+	}
+	if selected.Width >= targetWidth {
+		reasons = append(reasons, fmt.Sprintf("closest to %dpx at or above it", targetWidth))
+	} else {
+		reasons = append(reasons, fmt.Sprintf("widest, none reach %dpx", targetWidth))
+	}
+
+	return selected, fmt.Sprintf("%s: %s", describeVariant(selected), strings.Join(reasons, ", ")), nil
+}
+
+func describeRejections(rejected map[string]int) string {
+	reasons := make([]string, 0, len(rejected))
+	for reason, count := range rejected {
+		reasons = append(reasons, fmt.Sprintf("%d %s", count, reason))
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, ", ")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"aniart/m3u8"
+)
+
+func TestVariantPolicy(t *testing.T) {
+	variant := func(uri, codec string, width, bandwidth int, videoRange string) m3u8.Variant {
+		return m3u8.Variant{URI: uri, Codecs: []string{codec, "mp4a.40.2"}, Width: width, Height: width, Bandwidth: bandwidth, VideoRange: videoRange}
+	}
+	var (
+		avc400  = variant("avc400", "avc1.64001f", 400, 400000, "SDR")
+		avc640  = variant("avc640", "avc1.640028", 640, 900000, "SDR")
+		avc1080 = variant("avc1080", "avc1.640032", 1080, 2500000, "SDR")
+		// Same width as avc640, for less
+		avc640Lean = variant("avc640-lean", "avc1.640028", 640, 700000, "")
+		hevc640    = variant("hevc640", "hvc1.2.4.L123.B0", 640, 600000, "SDR")
+		hdr640     = variant("hdr640", "hvc1.2.4.L123.B0", 640, 800000, "PQ")
+		dovi1080   = variant("dovi1080", "dvh1.08.06", 1080, 2000000, "PQ")
+		av1        = variant("av1", "av01.0.08M.08", 640, 500000, "SDR")
+	)
+	defaults := VariantConfig{MinWidth: 450, PreferSDR: true, PreferCodec: "avc1"}
+
+	for _, tt := range []struct {
+		name     string
+		config   VariantConfig
+		variants []m3u8.Variant
+		target   int
+		want     string
+		// reason is part of the explanation
+		reason string
+	}{
+		{name: "narrowest at least the target", config: defaults, variants: []m3u8.Variant{avc1080, avc400, avc640}, target: 486, want: "avc640", reason: "closest to 486px"},
+		{name: "exactly the target", config: defaults, variants: []m3u8.Variant{avc1080, avc640}, target: 640, want: "avc640"},
+		{name: "widest when none reach the target", config: defaults, variants: []m3u8.Variant{avc640, avc1080}, target: 2000, want: "avc1080", reason: "widest, none reach 2000px"},
+		{name: "lower bandwidth at the same width", config: defaults, variants: []m3u8.Variant{avc640, avc640Lean}, target: 486, want: "avc640-lean"},
+		{name: "MIN_WIDTH", config: defaults, variants: []m3u8.Variant{avc400, avc1080}, target: 256, want: "avc1080", reason: "1 narrower than 450px"},
+		{name: "MIN_WIDTH 0", config: VariantConfig{}, variants: []m3u8.Variant{avc400, avc1080}, target: 256, want: "avc400"},
+		{name: "MAX_BANDWIDTH", config: VariantConfig{MaxBandwidth: 1000000}, variants: []m3u8.Variant{avc640, avc1080}, target: 1080, want: "avc640", reason: "1 over 1000000bps"},
+		{name: "unsupported codec", config: VariantConfig{}, variants: []m3u8.Variant{av1, avc1080}, target: 486, want: "avc1080", reason: "1 unsupported codec"},
+		{name: "SDR preferred", config: VariantConfig{PreferSDR: true}, variants: []m3u8.Variant{hdr640, dovi1080, avc1080}, target: 486, want: "avc1080", reason: "preferred SDR"},
+		{name: "HDR when there is nothing else", config: defaults, variants: []m3u8.Variant{hdr640, dovi1080}, target: 486, want: "hdr640"},
+		{name: "SDR not preferred", config: VariantConfig{}, variants: []m3u8.Variant{hdr640, avc1080}, target: 486, want: "hdr640"},
+		{name: "codec preferred", config: VariantConfig{PreferCodec: "hvc1"}, variants: []m3u8.Variant{avc640, hevc640}, target: 486, want: "hevc640", reason: "preferred hvc1"},
+		{name: "codec preferred after range", config: defaults, variants: []m3u8.Variant{hevc640, hdr640, avc1080}, target: 486, want: "avc1080", reason: "preferred SDR, preferred avc1"},
+		{name: "other codec when the preferred is missing", config: defaults, variants: []m3u8.Variant{hevc640, dovi1080}, target: 486, want: "hevc640"},
+		{name: "Dolby Vision is HEVC", config: VariantConfig{PreferCodec: "hvc1"}, variants: []m3u8.Variant{dovi1080, avc1080}, target: 486, want: "dovi1080"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, reason, err := variantPolicy{tt.config}.Select(tt.variants, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if selected.URI != tt.want {
+				t.Errorf("selected %s, want %s (%s)", selected.URI, tt.want, reason)
+			}
+			if !strings.Contains(reason, tt.reason) {
+				t.Errorf("reason %q doesn't say %q", reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestVariantPolicyNoneSuitable(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		config   VariantConfig
+		variants []m3u8.Variant
+		reason   string
+	}{
+		{name: "no variants", variants: nil, reason: "among 0 variants"},
+		{name: "every variant filtered", config: VariantConfig{MinWidth: 1000, MaxBandwidth: 1000000}, variants: []m3u8.Variant{
+			{URI: "narrow", Codecs: []string{"avc1.64001f"}, Width: 640, Bandwidth: 900000},
+			{URI: "heavy", Codecs: []string{"avc1.640032"}, Width: 1080, Bandwidth: 2500000},
+			{URI: "audio", Codecs: []string{"mp4a.40.2"}},
+		}, reason: "among 3 variants (1 narrower than 1000px, 1 over 1000000bps, 1 unsupported codec)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := variantPolicy{tt.config}.Select(tt.variants, 486)
+			if !errors.Is(err, ErrNoSuitableVariant) {
+				t.Fatalf("err = %v, want %v", err, ErrNoSuitableVariant)
+			}
+			if !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("err = %v, want it to say %q", err, tt.reason)
+			}
+		})
+	}
+}